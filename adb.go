@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+)
+
+// ADB is the set of adb operations used to check instances once they are connected.
+type ADB interface {
+	Shell(ctx context.Context, serial string, args ...string) (string, error)
+}
+
+// adbCLI implements ADB by shelling out to the adb binary.
+type adbCLI struct {
+	bin string
+}
+
+// newADBCLI returns an adb client using the adb binary of the Android SDK at sdkPath,
+// or the one on PATH when the SDK doesn't provide it.
+func newADBCLI(sdkPath string) *adbCLI {
+	bin := filepath.Join(sdkPath, "platform-tools", "adb")
+	if _, err := os.Stat(bin); sdkPath == "" || err != nil {
+		bin = "adb"
+	}
+	return &adbCLI{bin: bin}
+}
+
+// Shell runs a shell command on the device and returns its trimmed output.
+func (a *adbCLI) Shell(ctx context.Context, serial string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := command.NewWithCmd(exec.CommandContext(ctx, a.bin, append([]string{"-s", serial, "shell"}, args...)...)).SetStdout(&stdout).SetStderr(&stderr)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("%s aborted: %w", cmd.PrintableCommandArgs(), ctx.Err())
+		}
+		out := strings.TrimSpace(stdout.String() + "\n" + stderr.String())
+		return "", fmt.Errorf("%s failed, error: %s | output: %s", cmd.PrintableCommandArgs(), err, out)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const genymotionCloudAPIURL = "https://api.geny.io/cloud"
+
+// cloudAPIClient implements GMSaaS on top of the Genymotion Cloud REST API.
+// The ADB tunnel can't be opened over HTTP, so ADBConnect and SetConfig go through gmsaas,
+// as do the hardware profiles, OS images and recipe creation used by `hwprofile=...,osimage=...` entries.
+type cloudAPIClient struct {
+	baseURL      string
+	httpClient   *http.Client
+	pollInterval time.Duration
+	tunnel       GMSaaS
+
+	apiToken string
+	jwt      string
+}
+
+func newCloudAPIClient(baseURL string, tunnel GMSaaS) *cloudAPIClient {
+	c := &cloudAPIClient{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		pollInterval: 5 * time.Second,
+		tunnel:       tunnel,
+	}
+	c.httpClient = &http.Client{
+		Timeout: 60 * time.Second,
+		// The credentials headers would be sent along, redirects must stay within the API.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !c.inAPI(req.URL.String()) {
+				return fmt.Errorf("redirect to %s refused, it is outside of %s", req.URL.Redacted(), c.baseURL)
+			}
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			return nil
+		},
+	}
+	return c
+}
+
+// inAPI reports whether the absolute URL u is under the API base URL, the only place credentials are sent to.
+func (c *cloudAPIClient) inAPI(u string) bool {
+	return u == c.baseURL || strings.HasPrefix(u, c.baseURL+"/") || strings.HasPrefix(u, c.baseURL+"?")
+}
+
+type apiInstance struct {
+	UUID      string `json:"uuid"`
+	Name      string `json:"name"`
+	State     string `json:"state"`
+	ADBSerial string `json:"adb_serial"`
+}
+
+func (i apiInstance) toInstance() Instance {
+	return Instance{UUID: i.UUID, NAME: i.Name, STATE: i.State, ADB_SERIAL: i.ADBSerial}
+}
+
+type apiRecipe struct {
+	UUID            string `json:"uuid"`
+	Name            string `json:"name"`
+	Source          string `json:"source"`
+	HardwareProfile struct {
+		UUID           string `json:"uuid"`
+		DisplayWidth   int    `json:"width"`
+		DisplayHeight  int    `json:"height"`
+		DisplayDensity int    `json:"density"`
+	} `json:"hardware_profile"`
+	OSImage struct {
+		UUID      string `json:"uuid"`
+		OSVersion struct {
+			OSVersion string `json:"os_version"`
+		} `json:"os_version"`
+	} `json:"os_image"`
+}
+
+func (r apiRecipe) toRecipe() Recipe {
+	return Recipe{
+		UUID:            r.UUID,
+		NAME:            r.Name,
+		ANDROID_VERSION: r.OSImage.OSVersion.OSVersion,
+		SCREEN_WIDTH:    r.HardwareProfile.DisplayWidth,
+		SCREEN_HEIGHT:   r.HardwareProfile.DisplayHeight,
+		SCREEN_DENSITY:  r.HardwareProfile.DisplayDensity,
+		SOURCE:          r.Source,
+		HWPROFILE_UUID:  r.HardwareProfile.UUID,
+		OSIMAGE_UUID:    r.OSImage.UUID,
+	}
+}
+
+// apiError is returned when the API answers with an unexpected HTTP status.
+type apiError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s %s failed, status: %s | output: %s", e.Method, e.URL, e.Status, e.Body)
+}
+
+// do sends a request to the API and decodes the JSON response into out, when out is not nil.
+func (c *cloudAPIClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	// path is absolute for the pagination links of responses, which must point to the API.
+	endpoint := c.baseURL + path
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		if !c.inAPI(path) {
+			return fmt.Errorf("%s %s refused, it is outside of %s", method, path, c.baseURL)
+		}
+		endpoint = path
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gmsaas-bitrise-step bitrise.io")
+	if c.apiToken != "" {
+		req.Header.Set("x-api-token", c.apiToken)
+	} else if c.jwt != "" {
+		req.Header.Set("Authorization", "Bearer "+c.jwt)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s %s aborted: %w", method, endpoint, ctx.Err())
+		}
+		return fmt.Errorf("%s %s failed, error: %s", method, endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s %s failed, error: %s", method, endpoint, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &apiError{Method: method, URL: endpoint, StatusCode: resp.StatusCode, Status: resp.Status, Body: strings.TrimSpace(string(data))}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("issue with JSON parsing: %s | output: %s", err, data)
+	}
+	return nil
+}
+
+func (c *cloudAPIClient) Login(ctx context.Context, apiToken, email, password string) error {
+	switch {
+	case apiToken != "":
+		c.apiToken = apiToken
+	case email != "" && password != "":
+		var resp struct {
+			Token string `json:"token"`
+		}
+		body := map[string]string{"email": email, "password": password}
+		if err := c.do(ctx, http.MethodPost, "/v1/users/login", body, &resp); err != nil {
+			return err
+		}
+		c.jwt = resp.Token
+	default:
+		return fmt.Errorf("invalid arguments, must provide either a token or both email and password")
+	}
+
+	// gmsaas still opens the ADB tunnel, so it has to be authenticated as well.
+	return c.tunnel.Login(ctx, apiToken, email, password)
+}
+
+func (c *cloudAPIClient) SetConfig(ctx context.Context, key, value string) error {
+	return c.tunnel.SetConfig(ctx, key, value)
+}
+
+// StartInstance starts a disposable instance and waits for it to be online, like gmsaas does.
+func (c *cloudAPIClient) StartInstance(ctx context.Context, recipeUUID, name string) (Instance, error) {
+	var started apiInstance
+	body := map[string]interface{}{
+		"instance_name":      name,
+		"rename_on_conflict": false,
+		"stop_when_inactive": false,
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/recipes/"+url.PathEscape(recipeUUID)+"/start-disposable", body, &started); err != nil {
+		return Instance{}, err
+	}
+
+	instance := started.toInstance()
+	for {
+		switch instance.STATE {
+		case "ONLINE":
+			return instance, nil
+		case "ERROR", "DELETED", "DELETING", "STOPPING":
+			return instance, fmt.Errorf("instance %s is in %s state", instance.UUID, instance.STATE)
+		}
+
+		select {
+		case <-time.After(c.pollInterval):
+		case <-ctx.Done():
+			return instance, fmt.Errorf("instance %s is still %s: %w", instance.UUID, instance.STATE, ctx.Err())
+		}
+		var err error
+		if instance, err = c.GetInstance(ctx, started.UUID); err != nil {
+			return instance, err
+		}
+	}
+}
+
+func (c *cloudAPIClient) ADBConnect(ctx context.Context, instanceUUID, adbSerialPort string) (Instance, error) {
+	return c.tunnel.ADBConnect(ctx, instanceUUID, adbSerialPort)
+}
+
+func (c *cloudAPIClient) GetInstance(ctx context.Context, instanceUUID string) (Instance, error) {
+	var instance apiInstance
+	if err := c.do(ctx, http.MethodGet, "/v1/instances/"+url.PathEscape(instanceUUID), nil, &instance); err != nil {
+		return Instance{}, err
+	}
+	return instance.toInstance(), nil
+}
+
+// ListInstances lists instances of the account. The API doesn't know about the local
+// ADB tunnels, so the ADB serials are taken from gmsaas, when it can list them.
+func (c *cloudAPIClient) ListInstances(ctx context.Context) ([]Instance, error) {
+	instances := []Instance{}
+	next := "/v2/instances?page_size=100"
+	for next != "" {
+		var page struct {
+			Next    string        `json:"next"`
+			Results []apiInstance `json:"results"`
+		}
+		if err := c.do(ctx, http.MethodGet, next, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, instance := range page.Results {
+			instances = append(instances, instance.toInstance())
+		}
+		next = page.Next
+	}
+
+	// The listing doesn't depend on gmsaas, serials are left empty when it fails.
+	tunnels, err := c.tunnel.ListInstances(ctx)
+	if err != nil {
+		log.Warnf("Failed to get the ADB serials of the instances from gmsaas, error: %s", err)
+		return instances, nil
+	}
+	for i := range instances {
+		for _, tunnel := range tunnels {
+			if tunnel.UUID == instances[i].UUID && tunnel.ADB_SERIAL != "" {
+				instances[i].ADB_SERIAL = tunnel.ADB_SERIAL
+			}
+		}
+	}
+	return instances, nil
+}
+
+func (c *cloudAPIClient) StopInstance(ctx context.Context, instanceUUID string) error {
+	return c.do(ctx, http.MethodPost, "/v1/instances/"+url.PathEscape(instanceUUID)+"/stop-disposable", nil, nil)
+}
+
+func (c *cloudAPIClient) ListRecipes(ctx context.Context) ([]Recipe, error) {
+	recipes := []Recipe{}
+	next := "/v3/recipes/?limit=100"
+	for next != "" {
+		var page struct {
+			Next    string      `json:"next"`
+			Results []apiRecipe `json:"results"`
+		}
+		if err := c.do(ctx, http.MethodGet, next, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, recipe := range page.Results {
+			recipes = append(recipes, recipe.toRecipe())
+		}
+		next = page.Next
+	}
+	return recipes, nil
+}
+
+// Hardware profiles, OS images and custom recipes are managed through gmsaas.
+
+func (c *cloudAPIClient) ListHWProfiles(ctx context.Context) ([]HWProfile, error) {
+	return c.tunnel.ListHWProfiles(ctx)
+}
+
+func (c *cloudAPIClient) ListOSImages(ctx context.Context) ([]OSImage, error) {
+	return c.tunnel.ListOSImages(ctx)
+}
+
+func (c *cloudAPIClient) CreateRecipe(ctx context.Context, hwprofileUUID, osimageUUID, name string) (Recipe, error) {
+	return c.tunnel.CreateRecipe(ctx, hwprofileUUID, osimageUUID, name)
+}
+
+func (c *cloudAPIClient) DeleteRecipe(ctx context.Context, recipeUUID string) error {
+	return c.tunnel.DeleteRecipe(ctx, recipeUUID)
+}
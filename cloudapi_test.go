@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCloudAPI returns a client of a stand-in API server serving handler, with a fake gmsaas tunnel.
+func newTestCloudAPI(t *testing.T, handler http.HandlerFunc) (*cloudAPIClient, *fakeGMSaaS, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	tunnel := newFakeGMSaaS()
+	client := newCloudAPIClient(server.URL, tunnel)
+	client.pollInterval = time.Millisecond
+	return client, tunnel, server
+}
+
+func writeJSON(t *testing.T, w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Errorf("failed to encode response: %s", err)
+	}
+}
+
+func TestCloudAPILogin(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiToken   string
+		email      string
+		password   string
+		wantHeader string
+		wantValue  string
+		wantErr    bool
+	}{
+		{name: "token", apiToken: "secret-token", wantHeader: "x-api-token", wantValue: "secret-token"},
+		{name: "password", email: "user@example.com", password: "good", wantHeader: "Authorization", wantValue: "Bearer jwt-token"},
+		{name: "wrong password", email: "user@example.com", password: "bad", wantErr: true},
+		{name: "no credentials", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			headers := http.Header{}
+			client, tunnel, _ := newTestCloudAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v1/users/login":
+					var body map[string]string
+					if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+						t.Errorf("invalid login body: %s", err)
+					}
+					if body["password"] != "good" {
+						http.Error(w, `{"code":"BAD_CREDENTIALS"}`, http.StatusUnauthorized)
+						return
+					}
+					writeJSON(t, w, map[string]string{"token": "jwt-token"})
+				default:
+					mu.Lock()
+					headers = r.Header.Clone()
+					mu.Unlock()
+					writeJSON(t, w, map[string]interface{}{"results": []apiRecipe{}})
+				}
+			})
+
+			err := client.Login(context.Background(), tt.apiToken, tt.email, tt.password)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got no error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %s", err)
+			}
+			if len(tunnel.Calls) != 1 || tunnel.Calls[0] != "auth" {
+				t.Errorf("gmsaas calls: got %v, want the tunnel to be logged in too", tunnel.Calls)
+			}
+
+			if _, err := client.ListRecipes(context.Background()); err != nil {
+				t.Fatalf("got error %s", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got := headers.Get(tt.wantHeader); got != tt.wantValue {
+				t.Errorf("%s header: got %q, want %q", tt.wantHeader, got, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestCloudAPIListRecipesPaginated(t *testing.T) {
+	var server *httptest.Server
+	client, _, server := newTestCloudAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/recipes/" {
+			http.NotFound(w, r)
+			return
+		}
+		page := map[string]interface{}{}
+		recipe := apiRecipe{}
+		switch r.URL.Query().Get("offset") {
+		case "":
+			recipe.UUID, recipe.Name = "recipe-1", "Google Pixel 7"
+			recipe.OSImage.OSVersion.OSVersion = "14.0"
+			recipe.HardwareProfile.UUID, recipe.HardwareProfile.DisplayWidth = "hwprofile-1", 1080
+			page["next"] = server.URL + "/v3/recipes/?limit=100&offset=100"
+		case "100":
+			recipe.UUID, recipe.Name = "recipe-2", "Samsung Galaxy Tab S8"
+			recipe.OSImage.UUID = "osimage-2"
+		default:
+			t.Errorf("unexpected page %s", r.URL)
+		}
+		page["results"] = []apiRecipe{recipe}
+		writeJSON(t, w, page)
+	})
+
+	recipes, err := client.ListRecipes(context.Background())
+	if err != nil {
+		t.Fatalf("got error %s", err)
+	}
+	want := []Recipe{
+		{UUID: "recipe-1", NAME: "Google Pixel 7", ANDROID_VERSION: "14.0", SCREEN_WIDTH: 1080, HWPROFILE_UUID: "hwprofile-1"},
+		{UUID: "recipe-2", NAME: "Samsung Galaxy Tab S8", OSIMAGE_UUID: "osimage-2"},
+	}
+	if fmt.Sprint(recipes) != fmt.Sprint(want) {
+		t.Errorf("got %+v, want %+v", recipes, want)
+	}
+}
+
+func TestCloudAPIListInstancesPaginated(t *testing.T) {
+	var server *httptest.Server
+	client, tunnel, server := newTestCloudAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/instances" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("page") == "" {
+			writeJSON(t, w, map[string]interface{}{
+				"next":    server.URL + "/v2/instances?page_size=100&page=2",
+				"results": []apiInstance{{UUID: "instance-1", Name: "bitrise_0", State: "ONLINE"}},
+			})
+			return
+		}
+		writeJSON(t, w, map[string]interface{}{
+			"results": []apiInstance{{UUID: "instance-2", Name: "bitrise_1", State: "BOOTING"}},
+		})
+	})
+	// The ADB tunnel of instance-1 is only known to gmsaas.
+	tunnel.Starts["recipe"] = []fakeCall{{Instance: Instance{UUID: "instance-1"}}}
+	if _, err := tunnel.StartInstance(context.Background(), "recipe", "bitrise_0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tunnel.ADBConnect(context.Background(), "instance-1", "4321"); err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err := client.ListInstances(context.Background())
+	if err != nil {
+		t.Fatalf("got error %s", err)
+	}
+	want := []Instance{
+		{UUID: "instance-1", NAME: "bitrise_0", STATE: "ONLINE", ADB_SERIAL: "localhost:4321"},
+		{UUID: "instance-2", NAME: "bitrise_1", STATE: "BOOTING"},
+	}
+	if fmt.Sprint(instances) != fmt.Sprint(want) {
+		t.Errorf("got %+v, want %+v", instances, want)
+	}
+}
+
+func TestCloudAPIListInstancesWithoutTunnel(t *testing.T) {
+	client, tunnel, _ := newTestCloudAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, map[string]interface{}{
+			"results": []apiInstance{{UUID: "instance-1", Name: "bitrise_0", State: "ONLINE"}},
+		})
+	})
+	tunnel.ListErr = errors.New("gmsaas instances list failed")
+
+	instances, err := client.ListInstances(context.Background())
+	if err != nil {
+		t.Fatalf("got error %s, want the instances without ADB serials", err)
+	}
+	want := []Instance{{UUID: "instance-1", NAME: "bitrise_0", STATE: "ONLINE"}}
+	if fmt.Sprint(instances) != fmt.Sprint(want) {
+		t.Errorf("got %+v, want %+v", instances, want)
+	}
+}
+
+func TestCloudAPIStartInstancePolling(t *testing.T) {
+	tests := []struct {
+		name    string
+		states  []string
+		wantErr string
+	}{
+		{name: "online right away", states: []string{"ONLINE"}},
+		{name: "online after boot", states: []string{"CREATING", "STARTING", "BOOTING", "ONLINE"}},
+		{name: "error while booting", states: []string{"CREATING", "BOOTING", "ERROR"}, wantErr: "ERROR state"},
+		{name: "deleted while booting", states: []string{"CREATING", "DELETED"}, wantErr: "DELETED state"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			polls := 0
+			client, _, _ := newTestCloudAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case r.Method == http.MethodPost && r.URL.Path == "/v1/recipes/recipe-1/start-disposable":
+					var body map[string]interface{}
+					if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["instance_name"] != "bitrise_0" {
+						t.Errorf("invalid start body: %v %v", body, err)
+					}
+					writeJSON(t, w, apiInstance{UUID: "instance-1", Name: "bitrise_0", State: tt.states[0]})
+				case r.Method == http.MethodGet && r.URL.Path == "/v1/instances/instance-1":
+					polls++
+					if polls >= len(tt.states) {
+						t.Errorf("instance polled after it reached %s", tt.states[len(tt.states)-1])
+						polls = len(tt.states) - 1
+					}
+					writeJSON(t, w, apiInstance{UUID: "instance-1", Name: "bitrise_0", State: tt.states[polls]})
+				default:
+					http.NotFound(w, r)
+				}
+			})
+
+			instance, err := client.StartInstance(context.Background(), "recipe-1", "bitrise_0")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %s", err)
+			}
+			if instance.UUID != "instance-1" || instance.STATE != "ONLINE" {
+				t.Errorf("got %+v, want instance-1 ONLINE", instance)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if polls != len(tt.states)-1 {
+				t.Errorf("got %d polls, want %d", polls, len(tt.states)-1)
+			}
+		})
+	}
+}
+
+func TestCloudAPIStartInstanceTimeout(t *testing.T) {
+	client, _, _ := newTestCloudAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, apiInstance{UUID: "instance-1", State: "BOOTING"})
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := client.StartInstance(ctx, "recipe-1", "bitrise_0")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want a deadline exceeded", err)
+	}
+}
+
+func TestCloudAPIErrorStatus(t *testing.T) {
+	tests := []struct {
+		status        int
+		wantTransient bool
+	}{
+		{status: http.StatusTooManyRequests, wantTransient: true},
+		{status: http.StatusInternalServerError, wantTransient: true},
+		{status: http.StatusServiceUnavailable, wantTransient: true},
+		{status: http.StatusUnauthorized, wantTransient: false},
+		{status: http.StatusNotFound, wantTransient: false},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			client, _, _ := newTestCloudAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"code":"SOME_ERROR"}`, tt.status)
+			})
+
+			_, err := client.GetInstance(context.Background(), "instance-1")
+			var apiErr *apiError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("got error %v, want an apiError", err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Body != `{"code":"SOME_ERROR"}` {
+				t.Errorf("got %+v, want status %d and the response body", apiErr, tt.status)
+			}
+			if isTransient(err) != tt.wantTransient {
+				t.Errorf("isTransient: got %t, want %t", isTransient(err), tt.wantTransient)
+			}
+		})
+	}
+}
+
+func TestCloudAPIKeepsCredentialsWithinAPI(t *testing.T) {
+	tests := []struct {
+		name     string
+		response func(w http.ResponseWriter, r *http.Request, outside string)
+	}{
+		{
+			name: "next page outside of the API",
+			response: func(w http.ResponseWriter, r *http.Request, outside string) {
+				writeJSON(t, w, map[string]interface{}{"next": outside + "/v3/recipes/?offset=100", "results": []apiRecipe{}})
+			},
+		},
+		{
+			name: "redirect outside of the API",
+			response: func(w http.ResponseWriter, r *http.Request, outside string) {
+				http.Redirect(w, r, outside+"/v3/recipes/", http.StatusFound)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			leaked := []string{}
+			outside := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				leaked = append(leaked, r.Header.Get("x-api-token"))
+				mu.Unlock()
+				writeJSON(t, w, map[string]interface{}{"results": []apiRecipe{}})
+			}))
+			defer outside.Close()
+			client, _, _ := newTestCloudAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				tt.response(w, r, outside.URL)
+			})
+			if err := client.Login(context.Background(), "secret-token", "", ""); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := client.ListRecipes(context.Background()); err == nil || !strings.Contains(err.Error(), "outside of") {
+				t.Errorf("got error %v, want the request to be refused", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(leaked) > 0 {
+				t.Errorf("got %d requests outside of the API, want none", len(leaked))
+			}
+		})
+	}
+}
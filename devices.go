@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	// envVarPattern matches `$$`, `$VAR`, `${VAR}` and `${VAR:-default}`.
+	envVarPattern = regexp.MustCompile(`\$(\$|[A-Za-z_][A-Za-z0-9_]*|\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\})`)
+	localePattern = regexp.MustCompile(`^[a-z]{2,3}([_-][A-Z]{2})?$`)
+	// instanceLabelPattern restricts device names to what is safe in an instance name.
+	instanceLabelPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// devicesFile is the document pointed by the devices_file input.
+// devices is used when no profile is selected, profiles hold named alternatives like `smoke` or `full`.
+type devicesFile struct {
+	Devices  []deviceConfig            `json:"devices" yaml:"devices"`
+	Profiles map[string][]deviceConfig `json:"profiles" yaml:"profiles"`
+}
+
+// deviceConfig describes one device of the devices file, started count times.
+type deviceConfig struct {
+	Recipe        string    `json:"recipe" yaml:"recipe"`
+	Selector      string    `json:"selector" yaml:"selector"`
+	Count         *int      `json:"count" yaml:"count"`
+	ADBSerialPort portValue `json:"adb_serial_port" yaml:"adb_serial_port"`
+	Name          string    `json:"name" yaml:"name"`
+	Locale        string    `json:"locale" yaml:"locale"`
+	WaitForBoot   *bool     `json:"wait_for_boot" yaml:"wait_for_boot"`
+	BootTimeout   *int      `json:"boot_timeout" yaml:"boot_timeout"`
+}
+
+// portValue accepts a port written as a number or as a string like `4321-4324`.
+type portValue string
+
+func (p *portValue) UnmarshalJSON(data []byte) error {
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err == nil {
+		*p = portValue(number)
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("adb_serial_port must be a port or a range of ports")
+	}
+	*p = portValue(value)
+	return nil
+}
+
+// interpolateEnv replaces environment variables in content, `$$` being a literal `$`.
+// It returns the names of the variables which are neither set nor have a default value.
+func interpolateEnv(content string) (string, []string) {
+	missing := []string{}
+	expanded := envVarPattern.ReplaceAllStringFunc(content, func(match string) string {
+		groups := envVarPattern.FindStringSubmatch(match)
+		name := groups[1]
+		if name == "$" {
+			return "$"
+		}
+		if groups[2] != "" {
+			name = groups[2]
+		}
+		if value, ok := os.LookupEnv(name); ok && value != "" {
+			return value
+		}
+		if groups[3] != "" {
+			return groups[4]
+		}
+		missing = append(missing, name)
+		return ""
+	})
+	return expanded, missing
+}
+
+// typedDeviceKeys are the devices file keys holding numbers or booleans.
+var typedDeviceKeys = map[string]bool{
+	"count":           true,
+	"adb_serial_port": true,
+	"wait_for_boot":   true,
+	"boot_timeout":    true,
+}
+
+// interpolateValues interpolates environment variables in the string values of a decoded document,
+// so that comments and keys are left alone. When typed is set, a value made of a single variable,
+// like `${COUNT:-2}`, takes the type of what it expands to, so that it can be used for numbers and booleans too.
+// Values of the other keys, like name, stay strings whatever they expand to.
+func interpolateValues(value interface{}, typed bool, missing *[]string) interface{} {
+	switch v := value.(type) {
+	case string:
+		expanded, m := interpolateEnv(v)
+		*missing = append(*missing, m...)
+		if typed && v != "$$" && envVarPattern.FindString(v) == v {
+			if n, err := strconv.Atoi(expanded); err == nil && strconv.Itoa(n) == expanded {
+				return n
+			}
+			if b, err := strconv.ParseBool(expanded); err == nil && (expanded == "true" || expanded == "false") {
+				return b
+			}
+		}
+		return expanded
+	case map[interface{}]interface{}:
+		for key, item := range v {
+			name, _ := key.(string)
+			v[key] = interpolateValues(item, typedDeviceKeys[name], missing)
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = interpolateValues(item, typedDeviceKeys[key], missing)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = interpolateValues(item, false, missing)
+		}
+	}
+	return value
+}
+
+// decodeDevicesFile parses content as JSON when pth has a .json extension, as YAML otherwise, and interpolates
+// environment variables in its values. It returns the names of the variables which are neither set nor have a default value.
+// Unknown keys are rejected so that typos don't go unnoticed.
+func decodeDevicesFile(pth string, content []byte) (devicesFile, []string, error) {
+	var file devicesFile
+	var document interface{}
+	missing := []string{}
+	if strings.EqualFold(filepath.Ext(pth), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err != nil {
+			return file, nil, err
+		}
+		expanded, err := json.Marshal(interpolateValues(document, false, &missing))
+		if err != nil || len(missing) > 0 {
+			return file, missing, err
+		}
+		decoder = json.NewDecoder(bytes.NewReader(expanded))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&file)
+		return file, nil, err
+	}
+
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return file, nil, err
+	}
+	expanded, err := yaml.Marshal(interpolateValues(document, false, &missing))
+	if err != nil || len(missing) > 0 {
+		return file, missing, err
+	}
+	err = yaml.UnmarshalStrict(expanded, &file)
+	return file, nil, err
+}
+
+// deviceEntry checks device and converts it into a recipe entry, appending every problem found to problems.
+func deviceEntry(device deviceConfig, where string, problems *[]string) recipeEntry {
+	report := func(format string, args ...interface{}) {
+		*problems = append(*problems, where+": "+fmt.Sprintf(format, args...))
+	}
+
+	entry := recipeEntry{UUID: strings.TrimSpace(device.Recipe), Count: 1, Name: device.Name, Locale: device.Locale, WaitForBoot: device.WaitForBoot}
+	switch {
+	case entry.UUID != "" && device.Selector != "":
+		report("recipe and selector can't be used together")
+	case entry.UUID != "":
+		if !uuidPattern.MatchString(entry.UUID) {
+			report("recipe %s is not a valid UUID", entry.UUID)
+		}
+	case device.Selector != "":
+		for _, item := range parseList(device.Selector) {
+			term, err := parseSelectorTerm(item)
+			if err != nil {
+				report("selector %s", err)
+				continue
+			}
+			entry.Selector = append(entry.Selector, term)
+		}
+		if err := checkCombination(entry.Selector); err != nil {
+			report("selector %s", err)
+		}
+	default:
+		report("either recipe or selector is required")
+	}
+
+	if device.Count != nil {
+		if *device.Count < 1 {
+			report("count must be a positive number")
+		}
+		entry.Count = *device.Count
+	}
+
+	if device.ADBSerialPort != "" {
+		ports, portProblems := parsePorts(string(device.ADBSerialPort))
+		for _, problem := range portProblems {
+			report("%s", problem)
+		}
+		if len(portProblems) == 0 && len(ports) != entry.Count {
+			report("adb_serial_port: %d ports given for %d instances, there must be one port per instance", len(ports), entry.Count)
+		}
+		entry.Ports = ports
+	}
+
+	if device.Name != "" && !instanceLabelPattern.MatchString(device.Name) {
+		report("name %s may only contain letters, digits, `-` and `_`", device.Name)
+	}
+	if device.Locale != "" && !localePattern.MatchString(device.Locale) {
+		report("locale %s is not a locale like fr or fr-FR", device.Locale)
+	}
+	if device.BootTimeout != nil {
+		if *device.BootTimeout < 0 {
+			report("boot_timeout must not be negative")
+		}
+		entry.BootTimeout = *device.BootTimeout
+	}
+	return entry
+}
+
+// loadDevicesFile reads the devices file at pth, interpolates environment variables, validates it
+// and returns the recipe entries of profile, or of the top level devices when profile is empty.
+func loadDevicesFile(pth, profile string) ([]recipeEntry, error) {
+	content, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return nil, fmt.Errorf("devices_file: failed to read %s, error: %s", pth, err)
+	}
+	file, missing, err := decodeDevicesFile(pth, content)
+	if err != nil {
+		return nil, fmt.Errorf("devices_file: invalid %s, error: %s", pth, err)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("devices_file: environment variables %s are not set", strings.Join(missing, ", "))
+	}
+
+	devices, where := file.Devices, "devices"
+	if profile != "" {
+		var ok bool
+		if devices, ok = file.Profiles[profile]; !ok {
+			names := []string{}
+			for name := range file.Profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("devices_file: profile %s doesn't exist, available profiles: %s", profile, strings.Join(names, ", "))
+		}
+		where = "profiles." + profile
+	}
+	if len(devices) == 0 {
+		if profile == "" && len(file.Profiles) > 0 {
+			return nil, fmt.Errorf("devices_file: no top level devices, select one of the profiles with the profile input")
+		}
+		return nil, fmt.Errorf("devices_file: %s lists no device", where)
+	}
+
+	entries := []recipeEntry{}
+	problems := []string{}
+	for i, device := range devices {
+		entries = append(entries, deviceEntry(device, where+"["+strconv.Itoa(i)+"]", &problems))
+	}
+	if len(problems) > 0 {
+		return nil, errors.New("devices_file: invalid devices:\n- " + strings.Join(problems, "\n- "))
+	}
+	return entries, nil
+}
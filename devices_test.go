@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadDevicesFile(t *testing.T) {
+	noBoot := false
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		profile string
+		env     map[string]string
+		want    []recipeEntry
+		wantErr string
+	}{
+		{
+			name: "yaml",
+			file: "devices.yml",
+			content: `devices:
+  - recipe: ` + testRecipe1 + `
+    count: 2
+    adb_serial_port: 4321-4322
+  - recipe: ` + testRecipe2 + `
+    name: tablet
+    locale: fr-FR
+    wait_for_boot: false
+    boot_timeout: 60
+`,
+			want: []recipeEntry{
+				{UUID: testRecipe1, Count: 2, Ports: []string{"4321", "4322"}},
+				{UUID: testRecipe2, Count: 1, Name: "tablet", Locale: "fr-FR", WaitForBoot: &noBoot, BootTimeout: 60},
+			},
+		},
+		{
+			name: "json",
+			file: "devices.json",
+			content: `{"devices": [
+				{"recipe": "` + testRecipe1 + `", "count": 2, "adb_serial_port": "4321-4322"},
+				{"recipe": "` + testRecipe2 + `", "adb_serial_port": 5555, "wait_for_boot": false}
+			]}`,
+			want: []recipeEntry{
+				{UUID: testRecipe1, Count: 2, Ports: []string{"4321", "4322"}},
+				{UUID: testRecipe2, Count: 1, Ports: []string{"5555"}, WaitForBoot: &noBoot},
+			},
+		},
+		{
+			name:    "selector",
+			file:    "devices.yml",
+			content: "devices:\n  - selector: android=14,form=phone\n    count: 2\n",
+			want: []recipeEntry{
+				{Selector: recipeSelector{{Key: "android", Op: "=", Value: "14"}, {Key: "form", Op: "=", Value: "phone"}}, Count: 2},
+			},
+		},
+		{
+			name:    "yaml variables",
+			file:    "devices.yml",
+			content: "devices:\n  - recipe: ${RECIPE}\n    count: ${COUNT:-2}\n    name: ${BUILD_NUMBER}\n    wait_for_boot: $WAIT\n",
+			env:     map[string]string{"RECIPE": testRecipe1, "BUILD_NUMBER": "42", "WAIT": "false"},
+			want:    []recipeEntry{{UUID: testRecipe1, Count: 2, Name: "42", WaitForBoot: &noBoot}},
+		},
+		{
+			name:    "json variables",
+			file:    "devices.json",
+			content: `{"devices": [{"recipe": "${RECIPE}", "count": "${COUNT:-2}", "name": "${BUILD_NUMBER}", "wait_for_boot": "$WAIT", "adb_serial_port": "${PORTS}"}]}`,
+			env:     map[string]string{"RECIPE": testRecipe1, "BUILD_NUMBER": "42", "WAIT": "false", "PORTS": "4321-4322"},
+			want:    []recipeEntry{{UUID: testRecipe1, Count: 2, Name: "42", Ports: []string{"4321", "4322"}, WaitForBoot: &noBoot}},
+		},
+		{
+			name:    "set variable wins over its default",
+			file:    "devices.yml",
+			content: "devices:\n  - recipe: " + testRecipe1 + "\n    count: ${COUNT:-2}\n",
+			env:     map[string]string{"COUNT": "3"},
+			want:    []recipeEntry{{UUID: testRecipe1, Count: 3}},
+		},
+		{
+			name:    "variables in comments are ignored",
+			file:    "devices.yml",
+			content: "# count: ${UNSET_COUNT}\ndevices:\n  - recipe: " + testRecipe1 + " # $UNSET_RECIPE\n",
+			want:    []recipeEntry{{UUID: testRecipe1, Count: 1}},
+		},
+		{
+			name:    "missing variables",
+			file:    "devices.yml",
+			content: "devices:\n  - recipe: ${UNSET_RECIPE}\n    name: $UNSET_NAME\n",
+			wantErr: "environment variables",
+		},
+		{
+			name:    "profile",
+			file:    "devices.yml",
+			content: "profiles:\n  smoke:\n    - recipe: " + testRecipe1 + "\n  full:\n    - recipe: " + testRecipe1 + "\n    - recipe: " + testRecipe2 + "\n      count: 2\n",
+			profile: "full",
+			want:    []recipeEntry{{UUID: testRecipe1, Count: 1}, {UUID: testRecipe2, Count: 2}},
+		},
+		{
+			name:    "json profile",
+			file:    "devices.json",
+			content: `{"profiles": {"smoke": [{"recipe": "` + testRecipe1 + `", "count": "${COUNT:-1}"}]}}`,
+			profile: "smoke",
+			want:    []recipeEntry{{UUID: testRecipe1, Count: 1}},
+		},
+		{
+			name:    "unknown profile",
+			file:    "devices.yml",
+			content: "profiles:\n  smoke:\n    - recipe: " + testRecipe1 + "\n  full:\n    - recipe: " + testRecipe2 + "\n",
+			profile: "nightly",
+			wantErr: "profile nightly doesn't exist, available profiles: full, smoke",
+		},
+		{
+			name:    "profiles without profile input",
+			file:    "devices.yml",
+			content: "profiles:\n  smoke:\n    - recipe: " + testRecipe1 + "\n",
+			wantErr: "select one of the profiles with the profile input",
+		},
+		{
+			name:    "yaml unknown key",
+			file:    "devices.yml",
+			content: "devices:\n  - recipe: " + testRecipe1 + "\n    cuont: 2\n",
+			wantErr: "field cuont not found",
+		},
+		{
+			name:    "json unknown key",
+			file:    "devices.json",
+			content: `{"devices": [{"recipe": "` + testRecipe1 + `", "cuont": 2}]}`,
+			wantErr: `unknown field "cuont"`,
+		},
+		{
+			name:    "invalid values",
+			file:    "devices.yml",
+			content: "devices:\n  - recipe: not-a-uuid\n    count: 0\n  - selector: android=14\n    recipe: " + testRecipe1 + "\n    locale: french\n",
+			wantErr: "devices[0]: recipe not-a-uuid is not a valid UUID\n- devices[0]: count must be a positive number\n- devices[1]: recipe and selector can't be used together\n- devices[1]: locale french",
+		},
+		{
+			name:    "no device",
+			file:    "devices.yml",
+			content: "devices: []\n",
+			wantErr: "devices lists no device",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			pth := filepath.Join(t.TempDir(), tt.file)
+			if err := ioutil.WriteFile(pth, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := loadDevicesFile(pth, tt.profile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %s", err)
+			}
+			if !reflect.DeepEqual(entries, tt.want) {
+				t.Errorf("got %+v, want %+v", entries, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDevicesFileMissingVariables(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), "devices.json")
+	content := `{"devices": [{"recipe": "${UNSET_RECIPE}", "count": "${UNSET_COUNT}", "name": "${UNSET_NAME:-pixel}"}]}`
+	if err := ioutil.WriteFile(pth, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := loadDevicesFile(pth, "")
+	if err == nil {
+		t.Fatal("got no error, want the missing variables")
+	}
+	for _, name := range []string{"UNSET_RECIPE", "UNSET_COUNT"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("got error %s, want it to name %s", err, name)
+		}
+	}
+	if strings.Contains(err.Error(), "UNSET_NAME") {
+		t.Errorf("got error %s, UNSET_NAME has a default value", err)
+	}
+}
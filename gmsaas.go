@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+)
+
+// GMSaaS is the set of Genymotion Cloud SaaS operations used by the step.
+// Every operation is abandoned as soon as its context is done.
+type GMSaaS interface {
+	Login(ctx context.Context, apiToken, email, password string) error
+	SetConfig(ctx context.Context, key, value string) error
+	StartInstance(ctx context.Context, recipeUUID, name string) (Instance, error)
+	ADBConnect(ctx context.Context, instanceUUID, adbSerialPort string) (Instance, error)
+	GetInstance(ctx context.Context, instanceUUID string) (Instance, error)
+	ListInstances(ctx context.Context) ([]Instance, error)
+	StopInstance(ctx context.Context, instanceUUID string) error
+	ListRecipes(ctx context.Context) ([]Recipe, error)
+	ListHWProfiles(ctx context.Context) ([]HWProfile, error)
+	ListOSImages(ctx context.Context) ([]OSImage, error)
+	CreateRecipe(ctx context.Context, hwprofileUUID, osimageUUID, name string) (Recipe, error)
+	DeleteRecipe(ctx context.Context, recipeUUID string) error
+}
+
+// gmsaasCLI implements GMSaaS by shelling out to the gmsaas command line tool.
+type gmsaasCLI struct {
+	bin string
+}
+
+func newGMSaaSCLI(bin string) *gmsaasCLI {
+	return &gmsaasCLI{bin: bin}
+}
+
+// gmsaasError is returned when gmsaas exits with an error.
+type gmsaasError struct {
+	Command      string
+	Err          error
+	ExitCode     int
+	ExitCodeDesc string
+	Message      string
+	Output       string
+}
+
+func (e *gmsaasError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s failed, error: %s (%s) | message: %s", e.Command, e.Err, e.ExitCodeDesc, e.Message)
+	}
+	return fmt.Sprintf("%s failed, error: %s | output: %s", e.Command, e.Err, e.Output)
+}
+
+// newGMSaaSError builds the error of a failed gmsaas command, parsing the json error output when there is one.
+func newGMSaaSError(cmd *command.Model, err error, stdout, stderr string) *gmsaasError {
+	e := &gmsaasError{
+		Command: cmd.PrintableCommandArgs(),
+		Err:     err,
+		Output:  strings.TrimSpace(stdout + "\n" + stderr),
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		e.ExitCode = exitErr.ExitCode()
+	}
+
+	var output struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		ExitCodeDesc string `json:"exit_code_desc"`
+	}
+	if json.Unmarshal([]byte(strings.TrimSpace(stdout)), &output) == nil {
+		e.ExitCodeDesc = output.ExitCodeDesc
+		e.Message = output.Error.Message
+	}
+	return e
+}
+
+// run executes gmsaas with the given arguments and returns its trimmed stdout.
+// stderr is kept apart so that warnings printed by gmsaas don't end up in the JSON output.
+// The gmsaas process is killed when ctx is done.
+func (g *gmsaasCLI) run(ctx context.Context, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := command.NewWithCmd(exec.CommandContext(ctx, g.bin, args...)).SetStdout(&stdout).SetStderr(&stderr)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("%s aborted: %w", cmd.PrintableCommandArgs(), ctx.Err())
+		}
+		return "", newGMSaaSError(cmd, err, stdout.String(), stderr.String())
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// runJSON executes gmsaas with the json output format and parses its output.
+func (g *gmsaasCLI) runJSON(ctx context.Context, args ...string) (Output, error) {
+	var output Output
+	out, err := g.run(ctx, append([]string{"--format", "json"}, args...)...)
+	if err != nil {
+		return output, err
+	}
+	if err := json.Unmarshal([]byte(out), &output); err != nil {
+		return output, fmt.Errorf("issue with JSON parsing: %s | output: %s", err, out)
+	}
+	return output, nil
+}
+
+// UnmarshalJSON reads a recipe as gmsaas prints it, its hardware profile and OS image being nested objects,
+// which give the recipe its screen and Android version when they aren't set at the top level.
+func (r *Recipe) UnmarshalJSON(data []byte) error {
+	type flatRecipe Recipe
+	var recipe struct {
+		flatRecipe
+		HardwareProfile *HWProfile `json:"hardware_profile"`
+		OSImage         *OSImage   `json:"os_image"`
+	}
+	if err := json.Unmarshal(data, &recipe); err != nil {
+		return err
+	}
+	*r = Recipe(recipe.flatRecipe)
+
+	if hwprofile := recipe.HardwareProfile; hwprofile != nil {
+		r.HWPROFILE_UUID = hwprofile.UUID
+		if r.SCREEN_WIDTH == 0 && r.SCREEN_HEIGHT == 0 {
+			r.SCREEN_WIDTH, r.SCREEN_HEIGHT, r.SCREEN_DENSITY = hwprofile.DISPLAY_WIDTH, hwprofile.DISPLAY_HEIGHT, hwprofile.DISPLAY_DENSITY
+		}
+	}
+	if osimage := recipe.OSImage; osimage != nil {
+		r.OSIMAGE_UUID = osimage.UUID
+		if r.ANDROID_VERSION == "" {
+			r.ANDROID_VERSION = osimage.OS_VERSION
+		}
+	}
+	return nil
+}
+
+func (g *gmsaasCLI) Login(ctx context.Context, apiToken, email, password string) error {
+	if apiToken != "" {
+		_, err := g.run(ctx, "auth", "token", apiToken)
+		return err
+	}
+	if email != "" && password != "" {
+		_, err := g.run(ctx, "auth", "login", email, password)
+		return err
+	}
+	return fmt.Errorf("invalid arguments, must provide either a token or both email and password")
+}
+
+func (g *gmsaasCLI) SetConfig(ctx context.Context, key, value string) error {
+	_, err := g.run(ctx, "config", "set", key, value)
+	return err
+}
+
+func (g *gmsaasCLI) StartInstance(ctx context.Context, recipeUUID, name string) (Instance, error) {
+	output, err := g.runJSON(ctx, "instances", "start", recipeUUID, name)
+	return output.Instance, err
+}
+
+func (g *gmsaasCLI) ADBConnect(ctx context.Context, instanceUUID, adbSerialPort string) (Instance, error) {
+	args := []string{"instances", "adbconnect", instanceUUID}
+	if adbSerialPort != "" {
+		args = append(args, "--adb-serial-port", adbSerialPort)
+	}
+	output, err := g.runJSON(ctx, args...)
+	return output.Instance, err
+}
+
+func (g *gmsaasCLI) GetInstance(ctx context.Context, instanceUUID string) (Instance, error) {
+	output, err := g.runJSON(ctx, "instances", "get", instanceUUID)
+	return output.Instance, err
+}
+
+func (g *gmsaasCLI) ListInstances(ctx context.Context) ([]Instance, error) {
+	output, err := g.runJSON(ctx, "instances", "list")
+	return output.Instances, err
+}
+
+func (g *gmsaasCLI) StopInstance(ctx context.Context, instanceUUID string) error {
+	_, err := g.runJSON(ctx, "instances", "stop", instanceUUID)
+	return err
+}
+
+func (g *gmsaasCLI) ListRecipes(ctx context.Context) ([]Recipe, error) {
+	output, err := g.runJSON(ctx, "recipes", "list")
+	return output.Recipes, err
+}
+
+func (g *gmsaasCLI) ListHWProfiles(ctx context.Context) ([]HWProfile, error) {
+	output, err := g.runJSON(ctx, "hwprofiles", "list")
+	return output.HWProfiles, err
+}
+
+func (g *gmsaasCLI) ListOSImages(ctx context.Context) ([]OSImage, error) {
+	output, err := g.runJSON(ctx, "osimages", "list")
+	return output.OSImages, err
+}
+
+func (g *gmsaasCLI) CreateRecipe(ctx context.Context, hwprofileUUID, osimageUUID, name string) (Recipe, error) {
+	output, err := g.runJSON(ctx, "recipes", "create", hwprofileUUID, osimageUUID, name)
+	return output.Recipe, err
+}
+
+func (g *gmsaasCLI) DeleteRecipe(ctx context.Context, recipeUUID string) error {
+	_, err := g.runJSON(ctx, "recipes", "delete", recipeUUID)
+	return err
+}
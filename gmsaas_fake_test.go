@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// fakeCall scripts the outcome of a single fake gmsaas call.
+type fakeCall struct {
+	Delay    time.Duration
+	Err      error
+	Instance Instance
+}
+
+// fakeGMSaaS is an in-memory GMSaaS used to exercise the step without a Genymotion account.
+// Starts and Connects are keyed by recipe UUID and consumed in order, one entry per call;
+// once a recipe has no scripted call left, the call succeeds with a generated instance.
+type fakeGMSaaS struct {
+	mu sync.Mutex
+
+	LoginErr     error
+	SetConfigErr error
+	Starts       map[string][]fakeCall
+	Connects     map[string][]fakeCall
+	StopErr      error
+	ListErr      error
+	Recipes      []Recipe
+	HWProfiles   []HWProfile
+	OSImages     []OSImage
+
+	Config    map[string]string
+	Calls     []string
+	instances []Instance
+	recipes   map[string]string
+}
+
+func newFakeGMSaaS() *fakeGMSaaS {
+	return &fakeGMSaaS{
+		Starts:   map[string][]fakeCall{},
+		Connects: map[string][]fakeCall{},
+		Config:   map[string]string{},
+		recipes:  map[string]string{},
+	}
+}
+
+// next records the call and pops the next scripted outcome for key.
+func (f *fakeGMSaaS) next(calls map[string][]fakeCall, key, call string) fakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, call)
+	if len(calls[key]) == 0 {
+		return fakeCall{}
+	}
+	c := calls[key][0]
+	calls[key] = calls[key][1:]
+	return c
+}
+
+// fakeWait sleeps for delay, unless ctx is done first.
+func fakeWait(ctx context.Context, delay time.Duration) error {
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakeGMSaaS) Login(ctx context.Context, apiToken, email, password string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "auth")
+	return f.LoginErr
+}
+
+func (f *fakeGMSaaS) SetConfig(ctx context.Context, key, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "config set "+key)
+	if f.SetConfigErr != nil {
+		return f.SetConfigErr
+	}
+	f.Config[key] = value
+	return nil
+}
+
+func (f *fakeGMSaaS) StartInstance(ctx context.Context, recipeUUID, name string) (Instance, error) {
+	c := f.next(f.Starts, recipeUUID, "instances start "+recipeUUID+" "+name)
+	if err := fakeWait(ctx, c.Delay); err != nil {
+		return Instance{}, err
+	}
+	if c.Err != nil {
+		return Instance{}, c.Err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	instance := c.Instance
+	if instance.UUID == "" {
+		instance.UUID = fmt.Sprintf("fake-instance-%d", len(f.instances))
+	}
+	instance.NAME = name
+	if instance.STATE == "" {
+		instance.STATE = "ONLINE"
+	}
+	f.instances = append(f.instances, instance)
+	f.recipes[instance.UUID] = recipeUUID
+	return instance, nil
+}
+
+func (f *fakeGMSaaS) ADBConnect(ctx context.Context, instanceUUID, adbSerialPort string) (Instance, error) {
+	f.mu.Lock()
+	recipeUUID := f.recipes[instanceUUID]
+	f.mu.Unlock()
+
+	c := f.next(f.Connects, recipeUUID, "instances adbconnect "+instanceUUID)
+	if err := fakeWait(ctx, c.Delay); err != nil {
+		return Instance{}, err
+	}
+	if c.Err != nil {
+		return Instance{}, c.Err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.instances {
+		if f.instances[i].UUID != instanceUUID {
+			continue
+		}
+		switch {
+		case c.Instance.ADB_SERIAL != "":
+			f.instances[i].ADB_SERIAL = c.Instance.ADB_SERIAL
+		case adbSerialPort != "":
+			f.instances[i].ADB_SERIAL = "localhost:" + adbSerialPort
+		default:
+			f.instances[i].ADB_SERIAL = fmt.Sprintf("localhost:%d", 40000+i)
+		}
+		return f.instances[i], nil
+	}
+	return Instance{}, fmt.Errorf("instance %s not found", instanceUUID)
+}
+
+func (f *fakeGMSaaS) GetInstance(ctx context.Context, instanceUUID string) (Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "instances get "+instanceUUID)
+	for _, instance := range f.instances {
+		if instance.UUID == instanceUUID {
+			return instance, nil
+		}
+	}
+	return Instance{}, fmt.Errorf("instance %s not found", instanceUUID)
+}
+
+func (f *fakeGMSaaS) ListInstances(ctx context.Context) ([]Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "instances list")
+	if f.ListErr != nil {
+		return nil, f.ListErr
+	}
+	return append([]Instance(nil), f.instances...), nil
+}
+
+func (f *fakeGMSaaS) StopInstance(ctx context.Context, instanceUUID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "instances stop "+instanceUUID)
+	if f.StopErr != nil {
+		return f.StopErr
+	}
+	for i := range f.instances {
+		if f.instances[i].UUID == instanceUUID {
+			f.instances[i].STATE = "DELETED"
+			f.instances[i].ADB_SERIAL = ""
+			return nil
+		}
+	}
+	return fmt.Errorf("instance %s not found", instanceUUID)
+}
+
+func (f *fakeGMSaaS) ListRecipes(ctx context.Context) ([]Recipe, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "recipes list")
+	return append([]Recipe(nil), f.Recipes...), nil
+}
+
+func (f *fakeGMSaaS) ListHWProfiles(ctx context.Context) ([]HWProfile, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "hwprofiles list")
+	return append([]HWProfile(nil), f.HWProfiles...), nil
+}
+
+func (f *fakeGMSaaS) ListOSImages(ctx context.Context) ([]OSImage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "osimages list")
+	return append([]OSImage(nil), f.OSImages...), nil
+}
+
+func (f *fakeGMSaaS) CreateRecipe(ctx context.Context, hwprofileUUID, osimageUUID, name string) (Recipe, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "recipes create "+hwprofileUUID+" "+osimageUUID)
+	hwprofile := HWProfile{UUID: hwprofileUUID}
+	for _, h := range f.HWProfiles {
+		if h.UUID == hwprofileUUID {
+			hwprofile = h
+		}
+	}
+	osimage := OSImage{UUID: osimageUUID}
+	for _, o := range f.OSImages {
+		if o.UUID == osimageUUID {
+			osimage = o
+		}
+	}
+	recipe, err := gmsaasRecipe(fmt.Sprintf("fa4e0000-0000-4000-8000-%012d", len(f.Recipes)+1), name, hwprofile, osimage)
+	if err != nil {
+		return Recipe{}, err
+	}
+	f.Recipes = append(f.Recipes, recipe)
+	return recipe, nil
+}
+
+// gmsaasRecipe returns the recipe parsed from its gmsaas JSON form, the hardware profile and OS image being nested objects.
+func gmsaasRecipe(uuid, name string, hwprofile HWProfile, osimage OSImage) (Recipe, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"uuid":             uuid,
+		"name":             name,
+		"source":           "user",
+		"hardware_profile": hwprofile,
+		"os_image":         osimage,
+	})
+	if err != nil {
+		return Recipe{}, err
+	}
+	var recipe Recipe
+	err = json.Unmarshal(data, &recipe)
+	return recipe, err
+}
+
+func (f *fakeGMSaaS) DeleteRecipe(ctx context.Context, recipeUUID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "recipes delete "+recipeUUID)
+	for i := range f.Recipes {
+		if f.Recipes[i].UUID == recipeUUID {
+			f.Recipes = append(f.Recipes[:i], f.Recipes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("recipe %s not found", recipeUUID)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRecipeUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want Recipe
+	}{
+		{
+			name: "nested hardware profile and OS image",
+			json: `{"uuid": "recipe-1", "name": "Google Pixel 7", "source": "genymotion",
+				"hardware_profile": {"uuid": "hwprofile-1", "name": "Google Pixel 7", "display_width": 1080, "display_height": 2400, "display_density": 420},
+				"os_image": {"uuid": "osimage-1", "name": "Android 14.0", "os_version": "14.0"}}`,
+			want: Recipe{UUID: "recipe-1", NAME: "Google Pixel 7", SOURCE: "genymotion", ANDROID_VERSION: "14.0",
+				SCREEN_WIDTH: 1080, SCREEN_HEIGHT: 2400, SCREEN_DENSITY: 420, HWPROFILE_UUID: "hwprofile-1", OSIMAGE_UUID: "osimage-1"},
+		},
+		{
+			name: "top level values win",
+			json: `{"uuid": "recipe-1", "android_version": "14", "screen_width": 720, "screen_height": 1280,
+				"hardware_profile": {"uuid": "hwprofile-1", "display_width": 1080, "display_height": 2400},
+				"os_image": {"uuid": "osimage-1", "os_version": "14.0"}}`,
+			want: Recipe{UUID: "recipe-1", ANDROID_VERSION: "14", SCREEN_WIDTH: 720, SCREEN_HEIGHT: 1280, HWPROFILE_UUID: "hwprofile-1", OSIMAGE_UUID: "osimage-1"},
+		},
+		{
+			name: "no nested objects",
+			json: `{"uuid": "recipe-1", "name": "Custom", "android_version": "13.0"}`,
+			want: Recipe{UUID: "recipe-1", NAME: "Custom", ANDROID_VERSION: "13.0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output Output
+			if err := json.Unmarshal([]byte(`{"recipes": [`+tt.json+`]}`), &output); err != nil {
+				t.Fatalf("got error %s", err)
+			}
+			if len(output.Recipes) != 1 || output.Recipes[0] != tt.want {
+				t.Errorf("got %+v, want %+v", output.Recipes, tt.want)
+			}
+		})
+	}
+}
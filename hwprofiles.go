@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// combination returns the hwprofile and osimage values of a `hwprofile=...,osimage=...` selector.
+func (s recipeSelector) combination() (hwprofile, osimage string, ok bool) {
+	for _, term := range s {
+		switch term.Key {
+		case "hwprofile":
+			hwprofile = term.Value
+		case "osimage":
+			osimage = term.Value
+		}
+	}
+	return hwprofile, osimage, hwprofile != "" || osimage != ""
+}
+
+// checkCombination fails when a selector mixes hwprofile and osimage with other keys or lacks one of them.
+func checkCombination(s recipeSelector) error {
+	hwprofile, osimage, ok := s.combination()
+	if !ok {
+		return nil
+	}
+	if hwprofile == "" || osimage == "" || len(s) != 2 {
+		return fmt.Errorf("%s: hwprofile and osimage must be given together, without other keys", s)
+	}
+	return nil
+}
+
+// recipeCatalog lazily fetches the hardware profiles and OS images recipes are made of.
+type recipeCatalog struct {
+	client     GMSaaS
+	recipes    []Recipe
+	hwprofiles []HWProfile
+	osimages   []OSImage
+	loaded     bool
+
+	// created holds the recipes created by this run.
+	created []Recipe
+}
+
+func (c *recipeCatalog) load(ctx context.Context) error {
+	if c.loaded {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, gmsaasCallTimeout)
+	defer cancel()
+	var err error
+	if c.hwprofiles, err = c.client.ListHWProfiles(ctx); err != nil {
+		return fmt.Errorf("failed to list hardware profiles, error: %s", err)
+	}
+	if c.osimages, err = c.client.ListOSImages(ctx); err != nil {
+		return fmt.Errorf("failed to list OS images, error: %s", err)
+	}
+	c.loaded = true
+	return nil
+}
+
+// findHWProfile looks for a hardware profile by UUID or, case insensitively, by name.
+func (c *recipeCatalog) findHWProfile(value string) (HWProfile, error) {
+	matches := []HWProfile{}
+	for _, hwprofile := range c.hwprofiles {
+		if strings.EqualFold(hwprofile.UUID, value) || strings.EqualFold(hwprofile.NAME, value) {
+			matches = append(matches, hwprofile)
+		}
+	}
+	describe := func(hwprofiles []HWProfile) string {
+		lines := []string{}
+		for _, hwprofile := range hwprofiles {
+			lines = append(lines, fmt.Sprintf("  %s | %s | %dx%d@%d", hwprofile.UUID, hwprofile.NAME, hwprofile.DISPLAY_WIDTH, hwprofile.DISPLAY_HEIGHT, hwprofile.DISPLAY_DENSITY))
+		}
+		return strings.Join(lines, "\n")
+	}
+	switch len(matches) {
+	case 0:
+		return HWProfile{}, fmt.Errorf("hardware profile %s doesn't exist, available hardware profiles:\n%s", value, describe(c.hwprofiles))
+	case 1:
+		return matches[0], nil
+	default:
+		return HWProfile{}, fmt.Errorf("hardware profile %s is ambiguous, use its UUID:\n%s", value, describe(matches))
+	}
+}
+
+// findOSImage looks for an OS image by UUID or by Android version, `14` matching `14.0`.
+func (c *recipeCatalog) findOSImage(value string) (OSImage, error) {
+	matches := []OSImage{}
+	for _, osimage := range c.osimages {
+		if strings.EqualFold(osimage.UUID, value) || (!uuidPattern.MatchString(value) && compareVersions(osimage.OS_VERSION, value) == 0) {
+			matches = append(matches, osimage)
+		}
+	}
+	describe := func(osimages []OSImage) string {
+		lines := []string{}
+		for _, osimage := range osimages {
+			lines = append(lines, fmt.Sprintf("  %s | %s | Android %s", osimage.UUID, osimage.NAME, osimage.OS_VERSION))
+		}
+		return strings.Join(lines, "\n")
+	}
+	switch len(matches) {
+	case 0:
+		return OSImage{}, fmt.Errorf("OS image %s doesn't exist, available OS images:\n%s", value, describe(c.osimages))
+	case 1:
+		return matches[0], nil
+	default:
+		return OSImage{}, fmt.Errorf("OS image %s is ambiguous, use its UUID:\n%s", value, describe(matches))
+	}
+}
+
+// lookup finds the hardware profile and OS image of a `hwprofile=...,osimage=...` selector.
+func (c *recipeCatalog) lookup(ctx context.Context, selector recipeSelector) (HWProfile, OSImage, error) {
+	if err := c.load(ctx); err != nil {
+		return HWProfile{}, OSImage{}, err
+	}
+	hwprofileValue, osimageValue, _ := selector.combination()
+	hwprofile, err := c.findHWProfile(hwprofileValue)
+	if err != nil {
+		return HWProfile{}, OSImage{}, err
+	}
+	osimage, err := c.findOSImage(osimageValue)
+	return hwprofile, osimage, err
+}
+
+// recipeFor returns the recipe made of the hwprofile and osimage of selector, created when none exists yet.
+func (c *recipeCatalog) recipeFor(ctx context.Context, selector recipeSelector) (Recipe, error) {
+	hwprofile, osimage, err := c.lookup(ctx, selector)
+	if err != nil {
+		return Recipe{}, err
+	}
+
+	for _, recipe := range c.recipes {
+		if recipe.HWPROFILE_UUID == hwprofile.UUID && recipe.OSIMAGE_UUID == osimage.UUID {
+			log.Infof("Recipe selector %s resolved to existing recipe %s (%s)", selector, recipe.UUID, recipe.NAME)
+			return recipe, nil
+		}
+	}
+
+	name := fmt.Sprintf("%s - Android %s", hwprofile.NAME, osimage.OS_VERSION)
+	createCtx, cancel := context.WithTimeout(ctx, gmsaasCallTimeout)
+	defer cancel()
+	recipe, err := c.client.CreateRecipe(createCtx, hwprofile.UUID, osimage.UUID, name)
+	if err != nil {
+		return Recipe{}, fmt.Errorf("failed to create recipe %s, error: %s", name, err)
+	}
+	if recipe.ANDROID_VERSION == "" {
+		recipe.ANDROID_VERSION = osimage.OS_VERSION
+	}
+	log.Infof("Recipe selector %s resolved to created recipe %s (%s)", selector, recipe.UUID, recipe.NAME)
+	// Later entries asking for the same combination reuse it.
+	c.recipes = append(c.recipes, recipe)
+	c.created = append(c.created, recipe)
+	return recipe, nil
+}
+
+// deleteRecipes deletes, in parallel, the recipes created by this run.
+// It returns the UUIDs of the recipes which couldn't be deleted.
+func deleteRecipes(client GMSaaS, recipes []Recipe) []string {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	leaked := []string{}
+	for _, recipe := range recipes {
+		wg.Add(1)
+		go func(recipe Recipe) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), gmsaasCallTimeout)
+			defer cancel()
+			if err := client.DeleteRecipe(ctx, recipe.UUID); err != nil {
+				log.Errorf("Failed to delete recipe %s (%s), error: %s", recipe.UUID, recipe.NAME, err)
+				mu.Lock()
+				leaked = append(leaked, recipe.UUID)
+				mu.Unlock()
+				return
+			}
+			log.Infof("Recipe %s (%s) has been deleted", recipe.UUID, recipe.NAME)
+		}(recipe)
+	}
+	wg.Wait()
+	return leaked
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bitrise-io/go-steputils/tools"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+var gmsaasVersionPattern = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// cacheKeyOperators spell the operators of gmsaas_version in environment names.
+var cacheKeyOperators = map[string]string{
+	"==": "",
+	"~=": "compat",
+	"!=": "ne",
+	">=": "ge",
+	"<=": "le",
+	">":  "gt",
+	"<":  "lt",
+}
+
+// bitriseCacheIncludePaths is read by the Bitrise cache steps, one path per line.
+const bitriseCacheIncludePaths = "BITRISE_CACHE_INCLUDE_PATHS"
+
+// gmsaasInstaller installs gmsaas in its own environment under Dir, so that the system Python
+// is left untouched and Dir can be cached between builds. CacheDir holds the pip wheel cache.
+type gmsaasInstaller struct {
+	Dir        string
+	CacheDir   string
+	Constraint versionConstraint
+	Pip        pipOptions
+}
+
+// defaultGMSaaSInstallDir is used when the gmsaas_install_dir input is empty.
+func defaultGMSaaSInstallDir() string {
+	return filepath.Join(pathutil.UserHomeDir(), ".cache", "genymotion-gmsaas")
+}
+
+// pythonVersion returns the major and minor version of python3, like `3.11`, or `unknown`.
+func pythonVersion() string {
+	out, err := exec.Command("python3", "--version").CombinedOutput()
+	if err != nil {
+		return "unknown"
+	}
+	version := gmsaasVersionPattern.FindString(string(out))
+	if version == "" {
+		return "unknown"
+	}
+	return versionPrefix(version, 2)
+}
+
+// gmsaasCacheKey names the environment of an installation after gmsaas_version as requested, not after the
+// version installed, which is only known once installed: `gmsaas-1.11.0-py3.11`, `gmsaas-ge1.11-lt2-py3.11`,
+// or `gmsaas-latest-py3.11` when no version is requested. Changing the request or the Python version never reuses
+// a stale environment, but an environment still satisfying a range or `latest` is never upgraded.
+func gmsaasCacheKey(constraint versionConstraint, python string) string {
+	parts := []string{}
+	for _, condition := range constraint {
+		parts = append(parts, cacheKeyOperators[condition.Operator]+condition.Version)
+	}
+	version := strings.Join(parts, "-")
+	if version == "" {
+		version = "latest"
+	}
+	return fmt.Sprintf("gmsaas-%s-py%s", version, python)
+}
+
+// venvDir holds the virtualenv, venvBin is its gmsaas binary and pipxBin the one exposed by pipx.
+func (i gmsaasInstaller) venvDir() string { return filepath.Join(i.Dir, "venv") }
+func (i gmsaasInstaller) venvBin() string { return filepath.Join(i.venvDir(), "bin", "gmsaas") }
+func (i gmsaasInstaller) pipxBin() string { return filepath.Join(i.Dir, "bin", "gmsaas") }
+
+// requirement is the pip requirement of the requested version.
+func (i gmsaasInstaller) requirement() string {
+	return "gmsaas" + i.Constraint.String()
+}
+
+// check returns the version of bin, failing when it doesn't satisfy the requested constraint.
+func (i gmsaasInstaller) check(bin string) (string, error) {
+	version, err := gmsaasVersion(bin)
+	if err != nil {
+		return "", err
+	}
+	if !i.Constraint.satisfiedBy(version) {
+		return version, fmt.Errorf("gmsaas %s (%s) doesn't satisfy gmsaas_version %s", version, bin, i.Constraint)
+	}
+	return version, nil
+}
+
+// gmsaasVersion returns the version reported by `bin --version`.
+func gmsaasVersion(bin string) (string, error) {
+	out, err := exec.Command(bin, "--version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s --version failed, error: %s | output: %s", bin, err, out)
+	}
+	version := gmsaasVersionPattern.FindString(string(out))
+	if version == "" {
+		return "", fmt.Errorf("%s --version failed, error: no version found | output: %s", bin, out)
+	}
+	return version, nil
+}
+
+// installed returns the gmsaas binary of Dir, or else the one on PATH, when it satisfies the requested constraint.
+func (i gmsaasInstaller) installed() (string, bool) {
+	candidates := []string{i.venvBin(), i.pipxBin()}
+	if path, err := exec.LookPath("gmsaas"); err == nil {
+		candidates = append(candidates, path)
+	}
+	for _, bin := range candidates {
+		if _, err := os.Stat(bin); err != nil {
+			continue
+		}
+		version, err := i.check(bin)
+		if version == "" {
+			log.Warnf("Ignore broken gmsaas installation %s: %s", bin, err)
+			continue
+		}
+		if err != nil {
+			log.Infof("%s, it is left aside", err)
+			continue
+		}
+		log.Infof("gmsaas %s is already installed: %s", version, bin)
+		return bin, true
+	}
+	return "", false
+}
+
+// run runs an installation command with the pip and uv caches in CacheDir and the index URLs.
+func (i gmsaasInstaller) run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), i.cacheEnv()...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed, error: %s | output: %s", cmd.Args, err, out)
+	}
+	return nil
+}
+
+func (i gmsaasInstaller) cacheEnv() []string {
+	env := []string{"PIP_CACHE_DIR=" + i.CacheDir, "UV_CACHE_DIR=" + filepath.Join(i.CacheDir, "uv")}
+	return append(env, i.Pip.env()...)
+}
+
+// pipInstallArgs returns the arguments following `pip install`.
+func (i gmsaasInstaller) pipInstallArgs(uv bool) []string {
+	return append(i.Pip.options(uv), i.Pip.packages(i.requirement())...)
+}
+
+// installVenv installs gmsaas in a virtualenv, created and filled by uv when it is available.
+func (i gmsaasInstaller) installVenv() (string, error) {
+	python := filepath.Join(i.venvDir(), "bin", "python")
+	uv, uvErr := exec.LookPath("uv")
+	if _, err := os.Stat(python); err != nil {
+		if uvErr == nil {
+			err = i.run(uv, "venv", i.venvDir())
+		} else {
+			err = i.run("python3", "-m", "venv", i.venvDir())
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var err error
+	if uvErr == nil {
+		err = i.run(uv, append([]string{"pip", "install", "--python", python}, i.pipInstallArgs(true)...)...)
+	} else {
+		err = i.run(python, append([]string{"-m", "pip", "install"}, i.pipInstallArgs(false)...)...)
+	}
+	return i.venvBin(), err
+}
+
+// installPipx installs gmsaas with pipx, keeping both its environment and its binary under Dir.
+func (i gmsaasInstaller) installPipx() (string, error) {
+	pipx, err := exec.LookPath("pipx")
+	if err != nil {
+		return "", fmt.Errorf("pipx is not available")
+	}
+	if i.Pip.HashesFile != "" {
+		return "", fmt.Errorf("pipx can't install from a hashes file")
+	}
+	args := []string{"install", "--force"}
+	if options := i.Pip.options(false); len(options) > 0 {
+		args = append(args, "--pip-args", strings.Join(options, " "))
+	}
+	cmd := exec.Command(pipx, append(args, i.Pip.packages(i.requirement())...)...)
+	cmd.Env = append(os.Environ(), i.cacheEnv()...)
+	cmd.Env = append(cmd.Env, "PIPX_HOME="+filepath.Join(i.Dir, "pipx"), "PIPX_BIN_DIR="+filepath.Join(i.Dir, "bin"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%s failed, error: %s | output: %s", cmd.Args, err, out)
+	}
+	return i.pipxBin(), nil
+}
+
+// installSystem is the legacy installation in the system Python, used when no isolated environment can be set up.
+// A gmsaas already on PATH which doesn't satisfy the constraint is upgraded, or downgraded, in place.
+func (i gmsaasInstaller) installSystem() (string, error) {
+	args := append([]string{"install", "--upgrade"}, i.pipInstallArgs(false)...)
+	if err := i.run("pip3", append(args, "--break-system-packages")...); err != nil {
+		return "", err
+	}
+	// Execute asdf reshim to update PATH
+	exec.Command("asdf", "reshim", "python").CombinedOutput()
+
+	path, err := exec.LookPath("gmsaas")
+	if err != nil {
+		return "", fmt.Errorf("gmsaas has been installed but can't be found in PATH")
+	}
+	return path, nil
+}
+
+// installGMSaaS makes a gmsaas satisfying version, a version or a constraint like `>=1.11,<2`, available
+// and returns the path of the binary to use for every gmsaas command: from the cache in dir or from PATH
+// when it is already there, otherwise installed in a virtualenv, or with pipx, and as a last resort in the
+// system Python. It also returns the paths to cache between builds, none when gmsaas comes from PATH.
+func installGMSaaS(version, dir string, pip pipOptions) (string, []string, error) {
+	constraint, err := parseVersionConstraint(version)
+	if err != nil {
+		return "", nil, fmt.Errorf("gmsaas_version: %s", err)
+	}
+	if dir == "" {
+		dir = defaultGMSaaSInstallDir()
+	}
+	installer := gmsaasInstaller{
+		Dir:        filepath.Join(dir, gmsaasCacheKey(constraint, pythonVersion())),
+		CacheDir:   filepath.Join(dir, "pip-cache"),
+		Constraint: constraint,
+		Pip:        pip,
+	}
+	cachePaths := []string{installer.Dir, installer.CacheDir}
+	if bin, ok := installer.installed(); ok {
+		if !strings.HasPrefix(bin, installer.Dir+string(filepath.Separator)) {
+			return bin, nil, nil
+		}
+		return bin, cachePaths, nil
+	}
+
+	log.Infof("Installing %s in %s...", installer.requirement(), installer.Dir)
+	if err := os.MkdirAll(installer.Dir, 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create %s, error: %s", installer.Dir, err)
+	}
+	methods := []struct {
+		name    string
+		install func() (string, error)
+	}{
+		{"virtualenv", installer.installVenv},
+		{"pipx environment", installer.installPipx},
+	}
+	for _, method := range methods {
+		bin, err := method.install()
+		if err == nil {
+			_, err = installer.check(bin)
+		}
+		if err == nil {
+			log.Infof("%s has been installed in a %s: %s", installer.requirement(), method.name, bin)
+			return bin, cachePaths, nil
+		}
+		log.Warnf("Failed to install gmsaas in a %s: %s", method.name, err)
+	}
+
+	log.Warnf("Fall back to the system Python, with --break-system-packages")
+	bin, err := installer.installSystem()
+	if err == nil {
+		_, err = installer.check(bin)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to install %s, error: %s", installer.requirement(), err)
+	}
+	log.Infof("%s has been installed: %s", installer.requirement(), bin)
+	return bin, []string{installer.CacheDir}, nil
+}
+
+// exportCachePaths adds paths to the paths the Bitrise cache steps save, skipping the ones already listed.
+func exportCachePaths(paths []string) error {
+	current := os.Getenv(bitriseCacheIncludePaths)
+	lines := strings.Split(current, "\n")
+	listed := map[string]bool{}
+	for _, line := range lines {
+		listed[strings.TrimSpace(line)] = true
+	}
+	for _, pth := range paths {
+		if !listed[pth] {
+			lines = append(lines, pth)
+		}
+	}
+	value := strings.TrimSpace(strings.Join(lines, "\n"))
+	if value == strings.TrimSpace(current) {
+		return nil
+	}
+	return tools.ExportEnvironmentWithEnvman(bitriseCacheIncludePaths, value)
+}
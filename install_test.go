@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestGMSaaSCacheKey(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{version: "", want: "gmsaas-latest-py3.11"},
+		{version: "1.11.0", want: "gmsaas-1.11.0-py3.11"},
+		{version: "==1.11.0", want: "gmsaas-1.11.0-py3.11"},
+		{version: ">=1.11,<2", want: "gmsaas-ge1.11-lt2-py3.11"},
+		{version: "<=1.11", want: "gmsaas-le1.11-py3.11"},
+		{version: "~=1.11", want: "gmsaas-compat1.11-py3.11"},
+		{version: "!=1.10.1", want: "gmsaas-ne1.10.1-py3.11"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			constraint, err := parseVersionConstraint(tt.version)
+			if err != nil {
+				t.Fatalf("got error %s", err)
+			}
+			if got := gmsaasCacheKey(constraint, "3.11"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/bitrise-io/go-steputils/stepconf"
 	"github.com/bitrise-io/go-steputils/tools"
-	"github.com/bitrise-io/go-utils/command"
 	"github.com/bitrise-io/go-utils/log"
 )
 
@@ -19,66 +19,111 @@ import (
 const (
 	GMCloudSaaSInstanceUUID          = "GMCLOUD_SAAS_INSTANCE_UUID"
 	GMCloudSaaSInstanceADBSerialPort = "GMCLOUD_SAAS_INSTANCE_ADB_SERIAL_PORT"
+	GMCloudSaaSFailedRecipeUUID      = "GMCLOUD_SAAS_FAILED_RECIPE_UUID"
+	GMCloudSaaSFailedInstanceUUID    = "GMCLOUD_SAAS_FAILED_INSTANCE_UUID"
+	GMCloudSaaSInstanceRecipeUUID    = "GMCLOUD_SAAS_INSTANCE_RECIPE_UUID"
+	GMCloudSaaSInstancesJSONPath     = "GMCLOUD_SAAS_INSTANCES_JSON_PATH"
+	GMCloudSaaSInstanceCount         = "GMCLOUD_SAAS_INSTANCE_COUNT"
+	GMCloudSaaSCreatedRecipeUUID     = "GMCLOUD_SAAS_CREATED_RECIPE_UUID"
+
+	// Prefixes of the per-instance outputs, suffixed with the position of the instance in the joined outputs.
+	GMCloudSaaSInstanceUUIDPrefix       = "GMCLOUD_SAAS_INSTANCE_UUID_"
+	GMCloudSaaSInstanceADBSerialPrefix  = "GMCLOUD_SAAS_INSTANCE_ADB_SERIAL_"
+	GMCloudSaaSInstanceNamePrefix       = "GMCLOUD_SAAS_INSTANCE_NAME_"
+	GMCloudSaaSInstanceRecipeUUIDPrefix = "GMCLOUD_SAAS_INSTANCE_RECIPE_UUID_"
 )
 
-// Define variable
-var isError bool = false
-
 // Config ...
 type Config struct {
 	GMCloudSaaSEmail    string          `env:"email"`
 	GMCloudSaaSPassword stepconf.Secret `env:"password"`
 	GMCloudSaaSAPIToken stepconf.Secret `env:"api_token"`
 
-	GMCloudSaaSRecipeUUID    string `env:"recipe_uuid,required"`
-	GMCloudSaaSAdbSerialPort string `env:"adb_serial_port"`
-	GMCloudSaaSGmsaasVersion string `env:"gmsaas_version"`
+	GMCloudSaaSRecipeUUID       string `env:"recipe_uuid"`
+	GMCloudSaaSDevicesFile      string `env:"devices_file"`
+	GMCloudSaaSProfile          string `env:"profile"`
+	GMCloudSaaSNameTemplate     string `env:"instance_name_template"`
+	GMCloudSaaSAdbSerialPort    string `env:"adb_serial_port"`
+	GMCloudSaaSGmsaasVersion    string `env:"gmsaas_version"`
+	GMCloudSaaSGmsaasInstallDir string `env:"gmsaas_install_dir"`
+	GMCloudSaaSBackend          string `env:"backend,opt[gmsaas,api]"`
+
+	GMCloudSaaSDeleteCreatedRecipes bool `env:"delete_created_recipes,opt[true,false]"`
+
+	GMCloudSaaSPipIndexURL       stepconf.Secret `env:"pip_index_url"`
+	GMCloudSaaSPipExtraIndexURLs stepconf.Secret `env:"pip_extra_index_urls"`
+	GMCloudSaaSPipTrustedHosts   string          `env:"pip_trusted_hosts"`
+	GMCloudSaaSGmsaasWheelPath   string          `env:"gmsaas_wheel_path"`
+	GMCloudSaaSGmsaasHashesFile  string          `env:"gmsaas_hashes_file"`
+
+	GMCloudSaaSAndroidSDKPath string `env:"android_sdk_path"`
+
+	GMCloudSaaSStartTimeout   int `env:"start_timeout"`
+	GMCloudSaaSConnectTimeout int `env:"connect_timeout"`
+	GMCloudSaaSStartRetries   int `env:"start_retries"`
+	GMCloudSaaSConnectRetries int `env:"connect_retries"`
+
+	GMCloudSaaSOnPartialFailure string `env:"on_partial_failure,opt[rollback,keep]"`
+	GMCloudSaaSMinInstances     string `env:"min_instances"`
+
+	GMCloudSaaSWaitForBoot bool `env:"wait_for_boot,opt[true,false]"`
+	GMCloudSaaSBootTimeout int  `env:"boot_timeout"`
+
+	GMCloudSaaSMaxParallelStarts int `env:"max_parallel_starts"`
+	GMCloudSaaSStartStagger      int `env:"start_stagger"`
 }
 
 type Instance struct {
 	UUID       string `json:"uuid"`
 	ADB_SERIAL string `json:"adb_serial"`
 	NAME       string `json:"name"`
+	STATE      string `json:"state"`
 }
 
-type Output struct {
-	Instance  Instance   `json:"instance"`
-	Instances []Instance `json:"instances"`
+type Recipe struct {
+	UUID            string `json:"uuid"`
+	NAME            string `json:"name"`
+	ANDROID_VERSION string `json:"android_version"`
+	SCREEN_WIDTH    int    `json:"screen_width"`
+	SCREEN_HEIGHT   int    `json:"screen_height"`
+	SCREEN_DENSITY  int    `json:"screen_density"`
+	SOURCE          string `json:"source"`
+	HWPROFILE_UUID  string `json:"hwprofile_uuid"`
+	OSIMAGE_UUID    string `json:"osimage_uuid"`
 }
 
-// install gmsaas if not installed.
-func ensureGMSAASisInstalled(version string) error {
-	path, err := exec.LookPath("gmsaas")
-	if err != nil {
-		log.Infof("Installing gmsaas...")
-
-		var installCmd *exec.Cmd
-		if version != "" {
-			installCmd = exec.Command("pip3", "install", "gmsaas=="+version, "--break-system-packages")
-		} else {
-			installCmd = exec.Command("pip3", "install", "gmsaas", "--break-system-packages")
-		}
-
-		if out, err := installCmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("%s failed, error: %s | output: %s", installCmd.Args, err, out)
-		}
+type HWProfile struct {
+	UUID            string `json:"uuid"`
+	NAME            string `json:"name"`
+	DISPLAY_WIDTH   int    `json:"display_width"`
+	DISPLAY_HEIGHT  int    `json:"display_height"`
+	DISPLAY_DENSITY int    `json:"display_density"`
+	SOURCE          string `json:"source"`
+}
 
-		// Execute asdf reshim to update PATH
-		exec.Command("asdf", "reshim", "python").CombinedOutput()
+type OSImage struct {
+	UUID       string `json:"uuid"`
+	NAME       string `json:"name"`
+	OS_VERSION string `json:"os_version"`
+	API_LEVEL  int    `json:"api_level"`
+	SOURCE     string `json:"source"`
+}
 
-		if version != "" {
-			log.Infof("gmsaas %s has been installed.", version)
-		} else {
-			log.Infof("gmsaas has been installed.")
-		}
+type Output struct {
+	Instance   Instance    `json:"instance"`
+	Instances  []Instance  `json:"instances"`
+	Recipes    []Recipe    `json:"recipes"`
+	Recipe     Recipe      `json:"recipe"`
+	HWProfiles []HWProfile `json:"hwprofiles"`
+	OSImages   []OSImage   `json:"osimages"`
+}
 
-	} else {
-		log.Infof("gmsaas is already installed: %s", path)
+func newGMSaaS(backend, bin string) GMSaaS {
+	if backend == "api" {
+		log.Infof("Use Genymotion Cloud API backend")
+		return newCloudAPIClient(genymotionCloudAPIURL, newGMSaaSCLI(bin))
 	}
-
-	// Set Custom user agent to improve customer support
-	os.Setenv("GMSAAS_USER_AGENT_EXTRA_DATA", "bitrise.io")
-	return nil
+	return newGMSaaSCLI(bin)
 }
 
 // printError prints an error.
@@ -92,118 +137,277 @@ func abortf(format string, args ...interface{}) {
 	os.Exit(1)
 }
 
-// setOperationFailed marked step as failed
-func setOperationFailed(format string, args ...interface{}) {
-	printError(format, args...)
-	isError = true
+// startOptions tunes how each instance is started and connected.
+type startOptions struct {
+	StartTimeout   time.Duration
+	ConnectTimeout time.Duration
+	StartRetries   int
+	ConnectRetries int
+
+	// MaxParallelStarts bounds the number of instances provisioned at the same time, 0 means no limit.
+	MaxParallelStarts int
+	// StartStagger is the delay between two instance launches.
+	StartStagger time.Duration
+
+	// AutoPorts picks the ADB serial port of instances which don't have one, when set.
+	AutoPorts *portAllocator
+}
+
+// instanceSpec describes one instance to start.
+type instanceSpec struct {
+	Index          int
+	RecipeUUID     string
+	RecipeName     string
+	AndroidVersion string
+	Name           string
+	ADBSerialPort  string
+	Locale         string
+	WaitForBoot    bool
+	BootTimeout    time.Duration
+}
+
+// instanceSpecs expands entries into one spec per instance, numbered in order so that indices and names
+// are stable between runs. ports holds one port per instance or none, the entries settings override
+// the waitForBoot and bootTimeout inputs.
+func instanceSpecs(entries []recipeEntry, ports []string, names nameTemplate, waitForBoot bool, bootTimeout time.Duration) []instanceSpec {
+	specs := []instanceSpec{}
+	for _, entry := range entries {
+		for n := 0; n < entry.Count; n++ {
+			index := len(specs)
+			spec := instanceSpec{
+				Index:          index,
+				RecipeUUID:     entry.UUID,
+				RecipeName:     entry.Recipe.NAME,
+				AndroidVersion: entry.Recipe.ANDROID_VERSION,
+				Name:           names.render(index, entry.Recipe.NAME, entry.Name),
+				Locale:         entry.Locale,
+				WaitForBoot:    waitForBoot,
+				BootTimeout:    bootTimeout,
+			}
+			if len(ports) > index {
+				spec.ADBSerialPort = ports[index]
+			}
+			if entry.WaitForBoot != nil {
+				spec.WaitForBoot = *entry.WaitForBoot
+			}
+			if entry.BootTimeout > 0 {
+				spec.BootTimeout = time.Duration(entry.BootTimeout) * time.Second
+			}
+			specs = append(specs, spec)
+		}
+	}
+	return specs
 }
 
-func getADBSerialFromJSON(jsonData string) string {
-	var output Output
-	if err := json.Unmarshal([]byte(jsonData), &output); err != nil {
-		setOperationFailed("Issue with JSON parsing : %w", err)
+// bootPollInterval is the delay between two readiness checks over ADB.
+const bootPollInterval = 2 * time.Second
+
+// gmsaasCallTimeout bounds the gmsaas calls which have no timeout input of their own,
+// like login, configuration, recipe management and stops.
+const gmsaasCallTimeout = 2 * time.Minute
+
+// withTimeout returns a context cancelled after timeout, or only when ctx is when timeout is not positive.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-	return output.Instance.ADB_SERIAL
+	return context.WithTimeout(ctx, timeout)
 }
 
-func getInstanceDetails(name string) (string, string) {
-	cmd := command.New("gmsaas", "--format", "json", "instances", "list")
-	out, err := cmd.RunAndReturnTrimmedCombinedOutput()
+// findInstance looks for the instance named name which hasn't been deleted yet.
+func findInstance(ctx context.Context, client GMSaaS, name string) (Instance, bool) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	instances, err := client.ListInstances(ctx)
 	if err != nil {
-		setOperationFailed("Failed to get instances list, error: error: %s | output: %s", cmd.PrintableCommandArgs(), err, out)
-		return "", ""
+		log.Warnf("Failed to get instances list, error: %s", err)
+		return Instance{}, false
 	}
-	var output Output
-	if err := json.Unmarshal([]byte(out), &output); err != nil {
-		setOperationFailed("Issue with JSON parsing : %w", err)
+	for _, instance := range instances {
+		if instance.NAME == name && instance.STATE != "DELETED" && instance.STATE != "DELETING" {
+			return instance, true
+		}
 	}
+	return Instance{}, false
+}
 
-	for _, instance := range output.Instances {
-		if instance.NAME == name {
-			return instance.UUID, instance.ADB_SERIAL
-		}
+// recoverInstance deals with the instance a failed start attempt may have left behind:
+// it is reused when it is online, otherwise it is stopped so that it isn't leaked.
+func recoverInstance(ctx context.Context, client GMSaaS, name string) (Instance, bool) {
+	instance, found := findInstance(ctx, client, name)
+	if !found {
+		return Instance{}, false
+	}
+	if instance.STATE == "ONLINE" {
+		log.Infof("Reuse instance %s (%s) left online by the previous attempt", instance.UUID, name)
+		return instance, true
 	}
-	return "", ""
+
+	log.Warnf("Stop instance %s (%s) left in %s state by the previous attempt", instance.UUID, name, instance.STATE)
+	stopCtx, cancel := context.WithTimeout(ctx, gmsaasCallTimeout)
+	defer cancel()
+	if err := client.StopInstance(stopCtx, instance.UUID); err != nil {
+		log.Warnf("Failed to stop instance %s, error: %s", instance.UUID, err)
+	}
+	return Instance{}, false
 }
 
-func configureAndroidSDKPath() {
+// configureAndroidSDKPath sets the Android SDK used by gmsaas and returns its path.
+func configureAndroidSDKPath(client GMSaaS, explicitPath string) (string, error) {
 	log.Infof("Configure Android SDK configuration")
 
-	value, exists := os.LookupEnv("ANDROID_HOME")
-	if exists {
-		cmd := command.New("gmsaas", "config", "set", "android-sdk-path", value)
-		out, err := cmd.RunAndReturnTrimmedCombinedOutput()
-		if err != nil {
-			setOperationFailed("Failed to set android-sdk-path, error: error: %s | output: %s", cmd.PrintableCommandArgs(), err, out)
-			return
-		}
-		log.Infof("Android SDK is configured")
-	} else {
-		setOperationFailed("Please set ANDROID_HOME environment variable")
-		return
+	sdk, err := findAndroidSDK(explicitPath)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Using the Android SDK of %s: %s", sdk.Source, sdk.Path)
+	ctx, cancel := context.WithTimeout(context.Background(), gmsaasCallTimeout)
+	defer cancel()
+	if err := client.SetConfig(ctx, "android-sdk-path", sdk.Path); err != nil {
+		return "", fmt.Errorf("failed to set android-sdk-path, error: %s", err)
 	}
+	log.Infof("Android SDK is configured")
+	return sdk.Path, nil
 }
 
-func login(api_token, username, password string) {
+func login(client GMSaaS, api_token, username, password string) {
 	log.Infof("Login Genymotion Account")
 
-	var cmd *exec.Cmd
-	if api_token != "" {
-		cmd = exec.Command("gmsaas", "auth", "token", api_token)
-	} else if username != "" && password != "" {
-		cmd = exec.Command("gmsaas", "auth", "login", username, password)
-	} else {
+	if api_token == "" && (username == "" || password == "") {
 		abortf("Invalid arguments. Must provide either a token or both email and password.")
 		return
 	}
 
-	if out, err := cmd.CombinedOutput(); err != nil {
-		abortf("Failed to login with gmsaas, error: error: %s | output: %s", cmd.Args, err, out)
+	ctx, cancel := context.WithTimeout(context.Background(), gmsaasCallTimeout)
+	defer cancel()
+	if err := client.Login(ctx, api_token, username, password); err != nil {
+		abortf("Failed to login with gmsaas, error: %s", err)
 		return
 	}
 
 	log.Infof("Logged to Genymotion Cloud SaaS platform")
 }
 
-func startInstanceAndConnect(wg *sync.WaitGroup, recipeUUID, instanceName, adbSerialPort string) {
-	var output Output
-	defer wg.Done()
-	cmd := command.New("gmsaas", "--format", "json", "instances", "start", recipeUUID, instanceName)
-	jsonData, err := cmd.RunAndReturnTrimmedCombinedOutput()
+func startInstanceAndConnect(ctx context.Context, client GMSaaS, adb ADB, opts startOptions, spec instanceSpec) (result InstanceResult) {
+	recipeUUID, instanceName, adbSerialPort := spec.RecipeUUID, spec.Name, spec.ADBSerialPort
+	result = InstanceResult{Index: spec.Index, RecipeUUID: recipeUUID, Name: instanceName, Phase: PhaseStart}
+	begin := time.Now()
+	defer func() { result.Duration = time.Since(begin) }()
+
+	var instance Instance
+	err := retry(ctx, "Start "+instanceName, opts.StartRetries, func(attempt int) error {
+		if attempt > 1 {
+			if recovered, ok := recoverInstance(ctx, client, instanceName); ok {
+				instance = recovered
+				return nil
+			}
+		}
+		startCtx, cancel := withTimeout(ctx, opts.StartTimeout)
+		defer cancel()
+		var err error
+		instance, err = client.StartInstance(startCtx, recipeUUID, instanceName)
+		return err
+	})
 	if err != nil {
-		setOperationFailed("Failed to start a device, error: %s | output: %s\n", err, jsonData)
-		return
-	}
-
-	if err := json.Unmarshal([]byte(jsonData), &output); err != nil {
-		setOperationFailed("Issue with JSON parsing : %s", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			result.TimedOut = true
+			err = fmt.Errorf("timed out after %s: %s", opts.StartTimeout, err)
+		}
+		// The instance may have been created before gmsaas failed or was killed, keep track of it.
+		if leftover, found := findInstance(ctx, client, instanceName); found {
+			result.UUID = leftover.UUID
+		}
+		printError("Failed to start a device, error: %s", err)
+		result.Err = fmt.Errorf("failed to start: %s", err)
+		return result
 	}
+	result.UUID = instance.UUID
+	result.StartedAt = time.Now()
+
+	// Connect to adb, with adb-serial-port when given. The started instance is kept across attempts.
+	result.Phase = PhaseConnect
+	err = retry(ctx, "Connect "+instanceName, opts.ConnectRetries, func(attempt int) error {
+		port := adbSerialPort
+		if port == "" && opts.AutoPorts != nil {
+			var release func()
+			var err error
+			if port, release, err = opts.AutoPorts.Acquire(); err != nil {
+				return err
+			}
+			// The port stays locked until the tunnel is bound to it.
+			defer release()
+			log.Infof("Use free ADB serial port %s for instance %s", port, instanceName)
+		}
 
-	// Connect to adb with adb-serial-port
-	if adbSerialPort != "" {
-		cmd := command.New("gmsaas", "--format", "json", "instances", "adbconnect", output.Instance.UUID, "--adb-serial-port", adbSerialPort)
-		ADBjsonData, err := cmd.RunAndReturnTrimmedCombinedOutput()
-		if err != nil {
-			setOperationFailed("Failed to connect a device, error: error: %s | output: %s", cmd.PrintableCommandArgs(), err, ADBjsonData)
-			return
+		connectCtx, cancel := withTimeout(ctx, opts.ConnectTimeout)
+		defer cancel()
+		connected, err := client.ADBConnect(connectCtx, result.UUID, port)
+		if err == nil {
+			instance = connected
 		}
-		if err := json.Unmarshal([]byte(ADBjsonData), &output); err != nil {
-			setOperationFailed("Issue with JSON parsing : %s", err)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			result.TimedOut = true
+			err = fmt.Errorf("timed out after %s: %s", opts.ConnectTimeout, err)
 		}
-	} else {
-		cmd := command.New("gmsaas", "--format", "json", "instances", "adbconnect", output.Instance.UUID)
-		ADBjsonData, err := cmd.RunAndReturnTrimmedCombinedOutput()
+		printError("Failed to connect a device, error: %s", err)
+		result.Err = fmt.Errorf("failed to connect: %s", err)
+		return result
+	}
+	result.ADBSerial = instance.ADB_SERIAL
+	result.ConnectedAt = time.Now()
+
+	if spec.WaitForBoot || spec.Locale != "" {
+		result.Phase = PhaseReady
+		bootCtx, cancel := withTimeout(ctx, spec.BootTimeout)
+		err = prepareInstance(bootCtx, adb, spec, result.ADBSerial)
+		cancel()
 		if err != nil {
-			setOperationFailed("Failed to connect a device, error: error: %s | output: %s", cmd.PrintableCommandArgs(), err, ADBjsonData)
-			return
-		}
-		if err := json.Unmarshal([]byte(ADBjsonData), &output); err != nil {
-			setOperationFailed("Issue with JSON parsing : %s", err)
+			if errors.Is(err, context.DeadlineExceeded) {
+				result.TimedOut = true
+				err = fmt.Errorf("timed out after %s: %s", spec.BootTimeout, err)
+			}
+			printError("Failed to boot a device, error: %s", err)
+			result.Err = fmt.Errorf("failed to boot: %s", err)
+			return result
 		}
 	}
+	result.Phase = PhaseDone
+	result.ReadyAt = time.Now()
+
+	log.Infof("Genymotion instance UUID : %s has been started and connected with ADB Serial Port : %s", instance.UUID, instance.ADB_SERIAL)
+	return result
+}
 
-	log.Infof("Genymotion instance UUID : %s has been started and connected with ADB Serial Port : %s", output.Instance.UUID, output.Instance.ADB_SERIAL)
+// startInstances provisions every instance through a pool of at most opts.MaxParallelStarts workers,
+// launched opts.StartStagger apart. Results are in the same order as specs.
+func startInstances(ctx context.Context, client GMSaaS, adb ADB, opts startOptions, specs []instanceSpec) []InstanceResult {
+	workers := opts.MaxParallelStarts
+	if workers <= 0 || workers > len(specs) {
+		workers = len(specs)
+	}
+	sem := make(chan struct{}, workers)
 
+	var wg sync.WaitGroup
+	results := make([]InstanceResult, len(specs))
+	for i, spec := range specs {
+		sem <- struct{}{}
+		if i > 0 && opts.StartStagger > 0 {
+			time.Sleep(opts.StartStagger)
+		}
+		log.Infof("Start instance : %s  on Genymotion Cloud SaaS", spec.Name)
+		wg.Add(1)
+		go func(i int, spec instanceSpec) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// Each goroutine only writes its own slot, no locking is needed.
+			results[i] = startInstanceAndConnect(ctx, client, adb, opts, spec)
+		}(i, spec)
+	}
+	wg.Wait()
+	return results
 }
 
 func main() {
@@ -214,66 +418,207 @@ func main() {
 	}
 	stepconf.Print(c)
 
-	if err := ensureGMSAASisInstalled(c.GMCloudSaaSGmsaasVersion); err != nil {
+	if c.GMCloudSaaSStartTimeout < 0 || c.GMCloudSaaSConnectTimeout < 0 || c.GMCloudSaaSBootTimeout < 0 {
+		abortf("Issue with input: start_timeout, connect_timeout and boot_timeout must be positive, or 0 to disable them")
+	}
+	if c.GMCloudSaaSStartRetries < 0 || c.GMCloudSaaSConnectRetries < 0 {
+		abortf("Issue with input: start_retries and connect_retries must be positive")
+	}
+	if c.GMCloudSaaSMaxParallelStarts < 0 || c.GMCloudSaaSStartStagger < 0 {
+		abortf("Issue with input: max_parallel_starts and start_stagger must be positive")
+	}
+	opts := startOptions{
+		StartTimeout:   time.Duration(c.GMCloudSaaSStartTimeout) * time.Second,
+		ConnectTimeout: time.Duration(c.GMCloudSaaSConnectTimeout) * time.Second,
+		StartRetries:   c.GMCloudSaaSStartRetries,
+		ConnectRetries: c.GMCloudSaaSConnectRetries,
+
+		MaxParallelStarts: c.GMCloudSaaSMaxParallelStarts,
+		StartStagger:      time.Duration(c.GMCloudSaaSStartStagger) * time.Second,
+	}
+
+	// Inputs are validated before any cloud call, so that nothing is started for nothing.
+	var inputs validatedInputs
+	var err error
+	switch {
+	case c.GMCloudSaaSDevicesFile != "" && c.GMCloudSaaSRecipeUUID != "":
+		abortf("Issue with input: recipe_uuid and devices_file can't be used together")
+	case c.GMCloudSaaSDevicesFile != "":
+		inputs, err = validateDevicesFile(c.GMCloudSaaSDevicesFile, c.GMCloudSaaSProfile, c.GMCloudSaaSAdbSerialPort)
+	case c.GMCloudSaaSProfile != "":
+		abortf("Issue with input: profile can only be used with devices_file")
+	default:
+		inputs, err = validateInputs(c.GMCloudSaaSRecipeUUID, c.GMCloudSaaSAdbSerialPort)
+	}
+	if err != nil {
+		abortf("Issue with input: %s", err)
+	}
+	opts.AutoPorts = inputs.AutoPorts
+	names, err := newNameTemplate(c.GMCloudSaaSNameTemplate, time.Now())
+	if err != nil {
+		abortf("Issue with input: %s", err)
+	}
+	minInstances, err := parseMinInstances(c.GMCloudSaaSMinInstances, instanceCount(inputs.Recipes))
+	if err != nil {
+		abortf("Issue with input: %s", err)
+	}
+	// Unless they depend on the recipes, names are known before any cloud call.
+	if !names.usesRecipeName() {
+		if err := checkUniqueNames(instanceSpecs(inputs.Recipes, inputs.Ports, names, false, 0)); err != nil {
+			abortf("Issue with input: %s", err)
+		}
+	}
+
+	pip, err := newPipOptions(string(c.GMCloudSaaSPipIndexURL), string(c.GMCloudSaaSPipExtraIndexURLs), c.GMCloudSaaSPipTrustedHosts, c.GMCloudSaaSGmsaasWheelPath, c.GMCloudSaaSGmsaasHashesFile)
+	if err != nil {
+		abortf("Issue with input: %s", err)
+	}
+
+	gmsaasBin, cachePaths, err := installGMSaaS(c.GMCloudSaaSGmsaasVersion, c.GMCloudSaaSGmsaasInstallDir, pip)
+	if err != nil {
+		abortf("%s", err)
+	}
+	if err := exportCachePaths(cachePaths); err != nil {
+		printError("Failed to export %s, error: %v", bitriseCacheIncludePaths, err)
+	}
+	// Set Custom user agent to improve customer support
+	os.Setenv("GMSAAS_USER_AGENT_EXTRA_DATA", "bitrise.io")
+	client := newGMSaaS(c.GMCloudSaaSBackend, gmsaasBin)
+	sdkPath, err := configureAndroidSDKPath(client, c.GMCloudSaaSAndroidSDKPath)
+	if err != nil {
 		abortf("%s", err)
 	}
-	configureAndroidSDKPath()
+	adb := newADBCLI(sdkPath)
 
 	if err := tools.ExportEnvironmentWithEnvman("GMSAAS_USER_AGENT_EXTRA_DATA", "bitrise.io"); err != nil {
 		printError("Failed to export %s, error: %v", "GMSAAS_USER_AGENT_EXTRA_DATA", err)
 	}
 
 	if c.GMCloudSaaSAPIToken != "" {
-		login(string(c.GMCloudSaaSAPIToken), "", "")
+		login(client, string(c.GMCloudSaaSAPIToken), "", "")
 	} else {
-		login("", c.GMCloudSaaSEmail, string(c.GMCloudSaaSPassword))
+		login(client, "", c.GMCloudSaaSEmail, string(c.GMCloudSaaSPassword))
 	}
 
-	instancesList := []string{}
-	adbSerialList := []string{}
-	adbSerialPortList := []string{}
-
-	recipesList := strings.Split(c.GMCloudSaaSRecipeUUID, ",")
-
-	if len(c.GMCloudSaaSAdbSerialPort) >= 1 {
-		adbSerialPortList = strings.Split(c.GMCloudSaaSAdbSerialPort, ",")
+	recipes, createdRecipes, err := resolveRecipes(context.Background(), client, inputs.Recipes)
+	// Once recipes may have been created, every exit goes through deleteCreatedRecipes, which deletes them
+	// only once and only when requested. It returns the UUIDs of the created recipes left in the account.
+	recipesDeleted := false
+	deleteCreatedRecipes := func() []string {
+		leaked := []string{}
+		if c.GMCloudSaaSDeleteCreatedRecipes && !recipesDeleted {
+			recipesDeleted = true
+			leaked = deleteRecipes(client, createdRecipes)
+			if len(leaked) > 0 {
+				printError("Failed to delete recipes, please delete them manually: %s", strings.Join(leaked, ","))
+			}
+		} else if !c.GMCloudSaaSDeleteCreatedRecipes {
+			for _, recipe := range createdRecipes {
+				leaked = append(leaked, recipe.UUID)
+			}
+		}
+		return leaked
+	}
+	// abortWithCleanup reports the created recipes kept in the account, so that the next builds can reuse them.
+	abortWithCleanup := func(format string, args ...interface{}) {
+		if leaked := deleteCreatedRecipes(); len(leaked) > 0 {
+			log.Warnf("Recipes created by this run are kept in the account: %s", strings.Join(leaked, ","))
+			if err := tools.ExportEnvironmentWithEnvman(GMCloudSaaSCreatedRecipeUUID, strings.Join(leaked, ",")); err != nil {
+				printError("Failed to export %s, error: %v", GMCloudSaaSCreatedRecipeUUID, err)
+			}
+		}
+		abortf(format, args...)
+	}
+	if err != nil {
+		abortWithCleanup("%s", err)
 	}
 
 	workflowID := os.Getenv("BITRISE_TRIGGERED_WORKFLOW_ID")
 	log.Infof("Use workflow : %s ", workflowID)
 
-	log.Infof("Start %d Android instances on Genymotion Cloud SaaS", len(recipesList))
-	var wg sync.WaitGroup
-	t := time.Now().UnixNano()
-	for cptInstance := 0; cptInstance < len(recipesList); cptInstance++ {
-		instanceName := fmt.Sprint("bitrise_", workflowID, "_", t, "_", cptInstance)
-		log.Infof("Start instance : %s  on Genymotion Cloud SaaS", instanceName)
-		wg.Add(1)
-		if len(adbSerialPortList) >= 1 {
-			go startInstanceAndConnect(&wg, recipesList[cptInstance], instanceName, adbSerialPortList[cptInstance])
-		} else {
-			go startInstanceAndConnect(&wg, recipesList[cptInstance], instanceName, "")
+	specs := instanceSpecs(recipes, inputs.Ports, names, c.GMCloudSaaSWaitForBoot, time.Duration(c.GMCloudSaaSBootTimeout)*time.Second)
+	if err := checkUniqueNames(specs); err != nil {
+		abortWithCleanup("Issue with input: %s", err)
+	}
+	log.Infof("Start %d Android instances on Genymotion Cloud SaaS", len(specs))
+	results := startInstances(context.Background(), client, adb, opts, specs)
+
+	failed := failedResults(results)
+	succeeded := len(results) - len(failed)
+	thresholdMet, rolledBack := rollbackFailures(client, results, c.GMCloudSaaSOnPartialFailure, minInstances)
+
+	// The manifest describes every device, including the failed ones, so it is exported even when the step fails.
+	// The path is set even when only the copy to the deploy directory failed.
+	manifestPth, err := writeManifest(newManifest(specs, results, rolledBack), os.Getenv("BITRISE_DEPLOY_DIR"))
+	if err != nil {
+		printError("Failed to write the instances manifest, error: %s", err)
+	}
+	if manifestPth != "" {
+		if err := tools.ExportEnvironmentWithEnvman(GMCloudSaaSInstancesJSONPath, manifestPth); err != nil {
+			printError("Failed to export %s, error: %v", GMCloudSaaSInstancesJSONPath, err)
 		}
 	}
-	wg.Wait()
+	// Failed instances which are still running, kept or which couldn't be stopped, are exported
+	// before the step can fail, so that the stop step cleans them up too.
+	failedInstancesList := []string{}
+	for _, result := range failed {
+		if result.UUID != "" && !rolledBack[result.UUID] {
+			failedInstancesList = append(failedInstancesList, result.UUID)
+		}
+	}
+	if err := tools.ExportEnvironmentWithEnvman(GMCloudSaaSFailedInstanceUUID, strings.Join(failedInstancesList, ",")); err != nil {
+		printError("Failed to export %s, error: %v", GMCloudSaaSFailedInstanceUUID, err)
+	}
 
-	for cptInstance := 0; cptInstance < len(recipesList); cptInstance++ {
-		instanceName := fmt.Sprint("bitrise_", workflowID, "_", t, "_", cptInstance)
-		instanceUUID, InstanceADBSerialPort := getInstanceDetails(instanceName)
+	// Running instances don't need their recipe anymore, created recipes are exported when they are kept.
+	createdRecipesList := deleteCreatedRecipes()
+
+	if !thresholdMet && c.GMCloudSaaSOnPartialFailure == OnPartialFailureRollback {
+		abortf("Only %d instances started, %d required\n%s", succeeded, minInstances, resultsError(results))
+	}
 
-		instancesList = append(instancesList, instanceUUID)
-		adbSerialList = append(adbSerialList, InstanceADBSerialPort)
+	// Only the instances which have been started and connected are exported.
+	instancesList := []string{}
+	adbSerialList := []string{}
+	instanceRecipesList := []string{}
+	for _, result := range results {
+		if result.Succeeded() {
+			instancesList = append(instancesList, result.UUID)
+			adbSerialList = append(adbSerialList, result.ADBSerial)
+			instanceRecipesList = append(instanceRecipesList, result.RecipeUUID)
+		}
+	}
+	failedRecipesList := []string{}
+	for _, result := range failed {
+		failedRecipesList = append(failedRecipesList, result.RecipeUUID)
 	}
 
 	// --- Step Outputs: Export Environment Variables for other Steps:
 	outputs := map[string]string{
 		GMCloudSaaSInstanceUUID:          strings.Join(instancesList, ","),
 		GMCloudSaaSInstanceADBSerialPort: strings.Join(adbSerialList, ","),
+		GMCloudSaaSFailedRecipeUUID:      strings.Join(failedRecipesList, ","),
+		GMCloudSaaSInstanceRecipeUUID:    strings.Join(instanceRecipesList, ","),
+		GMCloudSaaSInstanceCount:         strconv.Itoa(len(instancesList)),
+		GMCloudSaaSCreatedRecipeUUID:     strings.Join(createdRecipesList, ","),
+	}
+	// Indexed outputs are numbered among the exported instances only, so that they line up with the joined ones.
+	position := 0
+	for _, result := range results {
+		if !result.Succeeded() {
+			continue
+		}
+		suffix := strconv.Itoa(position)
+		outputs[GMCloudSaaSInstanceUUIDPrefix+suffix] = result.UUID
+		outputs[GMCloudSaaSInstanceADBSerialPrefix+suffix] = result.ADBSerial
+		outputs[GMCloudSaaSInstanceNamePrefix+suffix] = result.Name
+		outputs[GMCloudSaaSInstanceRecipeUUIDPrefix+suffix] = result.RecipeUUID
+		position++
 	}
 
 	for k, v := range outputs {
 		if err := tools.ExportEnvironmentWithEnvman(k, v); err != nil {
-			abortf("Failed to export %s, error: %v", k, err)
+			abortWithCleanup("Failed to export %s, error: %v", k, err)
 		}
 	}
 
@@ -281,9 +626,15 @@ func main() {
 	// The exit code of your Step is very important. If you return
 	//  with a 0 exit code `bitrise` will register your Step as "successful".
 	// Any non zero exit code will be registered as "failed" by `bitrise`.
-	if isError {
-		// If at least one error happens, step will fail
-		os.Exit(1)
+	if !thresholdMet {
+		// If less instances than required have been started, step will fail
+		abortf("Only %d instances started, %d required\n%s", succeeded, minInstances, resultsError(results))
+	}
+	if err := resultsError(results); err != nil {
+		log.Warnf("%d instances started, %d required, the failed ones are ignored\n%s", succeeded, minInstances, err)
+		if len(failedInstancesList) > 0 {
+			log.Warnf("Failed instances still running, exported in %s: %s", GMCloudSaaSFailedInstanceUUID, strings.Join(failedInstancesList, ","))
+		}
 	}
 	os.Exit(0)
 }
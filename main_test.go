@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartInstances(t *testing.T) {
+	const (
+		recipeA = "e20da1a3-313c-434a-9d43-7268b12fee08"
+		recipeB = "c52fdfc2-6914-4266-aa6e-50258f50ef91"
+	)
+
+	tests := []struct {
+		name     string
+		starts   map[string][]fakeCall
+		connects map[string][]fakeCall
+		opts     startOptions
+		// want is the expected outcome of each instance: "ok", "failed" or "timed out".
+		want      []string
+		wantPhase []Phase
+	}{
+		{
+			name:      "every instance starts",
+			want:      []string{"ok", "ok"},
+			wantPhase: []Phase{PhaseDone, PhaseDone},
+		},
+		{
+			name: "scripted start failure",
+			starts: map[string][]fakeCall{
+				recipeB: {{Err: errors.New("Unable to start instance")}},
+			},
+			want:      []string{"ok", "failed"},
+			wantPhase: []Phase{PhaseDone, PhaseStart},
+		},
+		{
+			name: "scripted connect failure",
+			connects: map[string][]fakeCall{
+				recipeA: {{Err: errors.New("Unable to connect instance to ADB")}},
+			},
+			want:      []string{"failed", "ok"},
+			wantPhase: []Phase{PhaseConnect, PhaseDone},
+		},
+		{
+			name: "start slower than start_timeout",
+			starts: map[string][]fakeCall{
+				recipeA: {{Delay: time.Second}},
+			},
+			opts:      startOptions{StartTimeout: 50 * time.Millisecond},
+			want:      []string{"timed out", "ok"},
+			wantPhase: []Phase{PhaseStart, PhaseDone},
+		},
+		{
+			name: "connect slower than connect_timeout",
+			connects: map[string][]fakeCall{
+				recipeB: {{Delay: time.Second}},
+			},
+			opts:      startOptions{ConnectTimeout: 50 * time.Millisecond},
+			want:      []string{"ok", "timed out"},
+			wantPhase: []Phase{PhaseDone, PhaseConnect},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeGMSaaS()
+			for recipe, calls := range tt.starts {
+				client.Starts[recipe] = calls
+			}
+			for recipe, calls := range tt.connects {
+				client.Connects[recipe] = calls
+			}
+			specs := []instanceSpec{
+				{Index: 0, RecipeUUID: recipeA, Name: "test_0", ADBSerialPort: "4321"},
+				{Index: 1, RecipeUUID: recipeB, Name: "test_1", ADBSerialPort: "4322"},
+			}
+
+			results := startInstances(context.Background(), client, nil, tt.opts, specs)
+			if len(results) != len(specs) {
+				t.Fatalf("got %d results, want %d", len(results), len(specs))
+			}
+			for i, result := range results {
+				got := "ok"
+				switch {
+				case result.TimedOut:
+					got = "timed out"
+				case result.Err != nil:
+					got = "failed"
+				}
+				if got != tt.want[i] {
+					t.Errorf("instance #%d: got %s (%v), want %s", i, got, result.Err, tt.want[i])
+				}
+				if result.Phase != tt.wantPhase[i] {
+					t.Errorf("instance #%d: got phase %s, want %s", i, result.Phase, tt.wantPhase[i])
+				}
+				if result.Succeeded() != (tt.want[i] == "ok") {
+					t.Errorf("instance #%d: Succeeded() = %t", i, result.Succeeded())
+				}
+				if result.Succeeded() && result.ADBSerial != "localhost:"+specs[i].ADBSerialPort {
+					t.Errorf("instance #%d: got ADB serial %s, want localhost:%s", i, result.ADBSerial, specs[i].ADBSerialPort)
+				}
+				if result.Index != i || result.Name != specs[i].Name || result.RecipeUUID != specs[i].RecipeUUID {
+					t.Errorf("instance #%d: result %+v doesn't match its spec", i, result)
+				}
+			}
+		})
+	}
+}
+
+func TestStartInstanceAndConnectKeepsFailedInstanceUUID(t *testing.T) {
+	client := newFakeGMSaaS()
+	client.Connects["recipe"] = []fakeCall{{Err: errors.New("Unable to connect instance to ADB")}}
+
+	result := startInstanceAndConnect(context.Background(), client, nil, startOptions{}, instanceSpec{RecipeUUID: "recipe", Name: "test_0"})
+	if result.Succeeded() {
+		t.Fatalf("got success, want a connect failure")
+	}
+	// The instance is running, its UUID is needed to stop it.
+	if result.UUID == "" {
+		t.Errorf("got no instance UUID for an instance which has been started")
+	}
+	if !strings.Contains(result.Err.Error(), "failed to connect") {
+		t.Errorf("got error %q, want a connect failure", result.Err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+const manifestFileName = "genymotion_cloud_instances.json"
+
+// Statuses of the devices in the manifest.
+const (
+	StatusReady      = "ready"
+	StatusFailed     = "failed"
+	StatusTimedOut   = "timed_out"
+	StatusRolledBack = "rolled_back"
+)
+
+// manifestDevice is the manifest entry of one device, whether it has been provisioned or not.
+type manifestDevice struct {
+	Index          int        `json:"index"`
+	Name           string     `json:"name"`
+	RecipeUUID     string     `json:"recipe_uuid"`
+	RecipeName     string     `json:"recipe_name,omitempty"`
+	AndroidVersion string     `json:"android_version,omitempty"`
+	InstanceUUID   string     `json:"instance_uuid,omitempty"`
+	ADBSerial      string     `json:"adb_serial,omitempty"`
+	Status         string     `json:"status"`
+	Phase          Phase      `json:"phase"`
+	Error          string     `json:"error,omitempty"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	ConnectedAt    *time.Time `json:"connected_at,omitempty"`
+	ReadyAt        *time.Time `json:"ready_at,omitempty"`
+	Duration       float64    `json:"duration_seconds"`
+}
+
+type manifest struct {
+	Devices []manifestDevice `json:"devices"`
+}
+
+func timestamp(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// newManifest describes every device of specs from its result, results being in the same order as specs.
+// rolledBack holds the UUIDs of the instances stopped by the rollback.
+func newManifest(specs []instanceSpec, results []InstanceResult, rolledBack map[string]bool) manifest {
+	m := manifest{Devices: []manifestDevice{}}
+	for i, result := range results {
+		device := manifestDevice{
+			Index:          result.Index,
+			Name:           result.Name,
+			RecipeUUID:     result.RecipeUUID,
+			RecipeName:     specs[i].RecipeName,
+			AndroidVersion: specs[i].AndroidVersion,
+			InstanceUUID:   result.UUID,
+			ADBSerial:      result.ADBSerial,
+			Phase:          result.Phase,
+			StartedAt:      timestamp(result.StartedAt),
+			ConnectedAt:    timestamp(result.ConnectedAt),
+			ReadyAt:        timestamp(result.ReadyAt),
+			Duration:       result.Duration.Seconds(),
+		}
+		switch {
+		case rolledBack[result.UUID]:
+			device.Status = StatusRolledBack
+		case result.Succeeded():
+			device.Status = StatusReady
+		case result.TimedOut:
+			device.Status = StatusTimedOut
+		default:
+			device.Status = StatusFailed
+		}
+		if result.Err != nil {
+			device.Error = result.Err.Error()
+		}
+		m.Devices = append(m.Devices, device)
+	}
+	return m
+}
+
+// writeManifest writes m into a temporary directory and copies it into deployDir, when set,
+// so that it is available as a build artifact. It returns the path of the manifest.
+func writeManifest(m manifest, deployDir string) (string, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := pathutil.NormalizedOSTempDirPath("gmsaas-manifest")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary directory, error: %s", err)
+	}
+	pth := filepath.Join(dir, manifestFileName)
+	if err := ioutil.WriteFile(pth, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s, error: %s", pth, err)
+	}
+
+	if deployDir != "" {
+		if err := os.MkdirAll(deployDir, 0755); err != nil {
+			return pth, fmt.Errorf("failed to create %s, error: %s", deployDir, err)
+		}
+		deployPth := filepath.Join(deployDir, manifestFileName)
+		if err := ioutil.WriteFile(deployPth, data, 0644); err != nil {
+			return pth, fmt.Errorf("failed to copy the manifest to %s, error: %s", deployPth, err)
+		}
+	}
+	return pth, nil
+}
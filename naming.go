@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultInstanceNameTemplate = "bitrise_{workflow}_{timestamp}_{index}"
+	// maxInstanceNameLength keeps rendered names within what gmsaas accepts.
+	maxInstanceNameLength = 64
+)
+
+var (
+	placeholderPattern = regexp.MustCompile(`\{([a-z_]*)\}`)
+	unsafeNameChars    = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+	repeatedSeparators = regexp.MustCompile(`[-_.]{2,}`)
+)
+
+// namePlaceholders are the placeholders of instance_name_template, the per-instance ones are
+// only known when the instance is named.
+var namePlaceholders = map[string]bool{
+	"app_slug":     true,
+	"build_number": true,
+	"branch":       true,
+	"workflow":     true,
+	"timestamp":    true,
+	"index":        true,
+	"recipe_name":  true,
+	"device_name":  true,
+}
+
+// nameTemplate renders instance names from instance_name_template.
+type nameTemplate struct {
+	template string
+	vars     map[string]string
+}
+
+// newNameTemplate checks template, the default one when empty, and captures the build wide placeholders values.
+func newNameTemplate(template string, now time.Time) (nameTemplate, error) {
+	if strings.TrimSpace(template) == "" {
+		template = defaultInstanceNameTemplate
+	}
+	unknown := []string{}
+	for _, match := range placeholderPattern.FindAllStringSubmatch(template, -1) {
+		if !namePlaceholders[match[1]] {
+			unknown = append(unknown, match[0])
+		}
+	}
+	if len(unknown) > 0 {
+		known := []string{}
+		for name := range namePlaceholders {
+			known = append(known, "{"+name+"}")
+		}
+		sort.Strings(known)
+		return nameTemplate{}, fmt.Errorf("instance_name_template: unknown placeholders %s, available ones are %s", strings.Join(unknown, " "), strings.Join(known, " "))
+	}
+
+	return nameTemplate{
+		template: template,
+		vars: map[string]string{
+			"app_slug":     os.Getenv("BITRISE_APP_SLUG"),
+			"build_number": os.Getenv("BITRISE_BUILD_NUMBER"),
+			"branch":       os.Getenv("BITRISE_GIT_BRANCH"),
+			"workflow":     os.Getenv("BITRISE_TRIGGERED_WORKFLOW_ID"),
+			"timestamp":    strconv.FormatInt(now.UnixNano(), 10),
+		},
+	}, nil
+}
+
+// shrinkablePlaceholders are the placeholders whose values are shortened when a name is too long,
+// the literal text of the template, {index}, {timestamp} and {device_name} telling instances apart.
+var shrinkablePlaceholders = map[string]bool{
+	"app_slug":     true,
+	"build_number": true,
+	"branch":       true,
+	"workflow":     true,
+	"recipe_name":  true,
+}
+
+// namePart is a piece of a rendered name.
+type namePart struct {
+	text       string
+	shrinkable bool
+}
+
+// usesRecipeName reports whether names depend on the recipes, which are only known once resolved.
+func (t nameTemplate) usesRecipeName() bool {
+	return strings.Contains(t.template, "{recipe_name}")
+}
+
+// render names the instance at index. deviceName, the name of a devices file entry, is appended
+// when the template doesn't place it.
+func (t nameTemplate) render(index int, recipeName, deviceName string) string {
+	parts := []namePart{}
+	last := 0
+	for _, loc := range placeholderPattern.FindAllStringSubmatchIndex(t.template, -1) {
+		parts = append(parts, namePart{text: t.template[last:loc[0]]})
+		value := ""
+		switch key := t.template[loc[2]:loc[3]]; key {
+		case "index":
+			value = strconv.Itoa(index)
+		case "recipe_name":
+			value = recipeName
+		case "device_name":
+			value = deviceName
+		default:
+			value = t.vars[key]
+		}
+		parts = append(parts, namePart{text: value, shrinkable: shrinkablePlaceholders[t.template[loc[2]:loc[3]]]})
+		last = loc[1]
+	}
+	parts = append(parts, namePart{text: t.template[last:]})
+	if deviceName != "" && !strings.Contains(t.template, "{device_name}") {
+		parts = append(parts, namePart{text: "_" + deviceName})
+	}
+	return shortenInstanceName(parts)
+}
+
+// shortenInstanceName joins and sanitizes parts, shortening the longest placeholder values first
+// until the name fits in maxInstanceNameLength. When the fixed parts alone don't fit, the middle
+// of the name is cut, so that its end, usually {index}, is kept.
+func shortenInstanceName(parts []namePart) string {
+	join := func() string {
+		texts := []string{}
+		for _, part := range parts {
+			texts = append(texts, part.text)
+		}
+		return sanitizeInstanceName(strings.Join(texts, ""))
+	}
+
+	name := join()
+	for len(name) > maxInstanceNameLength {
+		longest := -1
+		for i, part := range parts {
+			if part.shrinkable && part.text != "" && (longest == -1 || len(part.text) > len(parts[longest].text)) {
+				longest = i
+			}
+		}
+		if longest == -1 {
+			break
+		}
+		parts[longest].text = parts[longest].text[:len(parts[longest].text)-1]
+		name = join()
+	}
+
+	if len(name) > maxInstanceNameLength {
+		head := maxInstanceNameLength / 2
+		name = sanitizeInstanceName(name[:head] + "-" + name[len(name)-(maxInstanceNameLength-head-1):])
+	}
+	return name
+}
+
+// sanitizeInstanceName replaces the characters gmsaas doesn't accept, eg. the `/` of branch names.
+func sanitizeInstanceName(name string) string {
+	name = unsafeNameChars.ReplaceAllString(name, "-")
+	name = repeatedSeparators.ReplaceAllStringFunc(name, func(run string) string { return run[:1] })
+	return strings.Trim(name, "-_.")
+}
+
+// checkUniqueNames fails when two instances of specs have the same name, or an empty one,
+// since instances are found back by name when a start attempt is retried.
+func checkUniqueNames(specs []instanceSpec) error {
+	problems := []string{}
+	seen := map[string]int{}
+	for _, spec := range specs {
+		if spec.Name == "" {
+			problems = append(problems, fmt.Sprintf("instance #%d has an empty name", spec.Index))
+			continue
+		}
+		if first, ok := seen[spec.Name]; ok {
+			problems = append(problems, fmt.Sprintf("instances #%d and #%d are both named %s", first, spec.Index, spec.Name))
+			continue
+		}
+		seen[spec.Name] = spec.Index
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("instance_name_template: instance names must be unique, use {index}:\n- %s", strings.Join(problems, "\n- "))
+	}
+	return nil
+}
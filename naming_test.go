@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNameTemplateRender(t *testing.T) {
+	tests := []struct {
+		name       string
+		template   string
+		env        map[string]string
+		index      int
+		recipeName string
+		deviceName string
+		want       string
+	}{
+		{
+			name:  "default template",
+			env:   map[string]string{"BITRISE_TRIGGERED_WORKFLOW_ID": "primary"},
+			index: 2,
+			want:  "bitrise_primary_1700000000000000000_2",
+		},
+		{
+			name:  "separators collapsed around an empty workflow",
+			index: 0,
+			want:  "bitrise_1700000000000000000_0",
+		},
+		{
+			name:     "branch sanitized",
+			template: "{branch}_{index}",
+			env:      map[string]string{"BITRISE_GIT_BRANCH": "feature//login__form"},
+			index:    1,
+			want:     "feature-login_form_1",
+		},
+		{
+			name:     "long branch shortened",
+			template: "{branch}_{index}",
+			env:      map[string]string{"BITRISE_GIT_BRANCH": "feature/" + strings.Repeat("a", 80)},
+			index:    3,
+			want:     "feature-" + strings.Repeat("a", 54) + "_3",
+		},
+		{
+			name:     "longest values shortened first",
+			template: "{workflow}_{branch}_{index}",
+			env:      map[string]string{"BITRISE_TRIGGERED_WORKFLOW_ID": strings.Repeat("w", 40), "BITRISE_GIT_BRANCH": strings.Repeat("b", 40)},
+			index:    7,
+			want:     strings.Repeat("w", 30) + "_" + strings.Repeat("b", 31) + "_7",
+		},
+		{
+			name:       "non-ASCII recipe name",
+			template:   "{recipe_name}_{index}",
+			index:      0,
+			recipeName: "Téléphone Ünïcode 7",
+			want:       "T-l-phone-n-code-7_0",
+		},
+		{
+			name:       "long non-ASCII recipe name",
+			template:   "{recipe_name}_{index}",
+			index:      12,
+			recipeName: strings.Repeat("Pixel ü ", 12),
+			want:       strings.Repeat("Pixel-", 10) + "P_12",
+		},
+		{
+			name:     "fixed text too long, middle cut",
+			template: strings.Repeat("x", 70) + "_{index}",
+			index:    4,
+			want:     strings.Repeat("x", 32) + "-" + strings.Repeat("x", 29) + "_4",
+		},
+		{
+			name:       "device name suffix",
+			template:   "bitrise_{index}",
+			index:      0,
+			deviceName: "tablet",
+			want:       "bitrise_0_tablet",
+		},
+		{
+			name:       "device name placed by the template",
+			template:   "{device_name}-{index}",
+			index:      1,
+			deviceName: "tablet",
+			want:       "tablet-1",
+		},
+		{
+			name:       "device name suffix kept when shortening",
+			template:   "{branch}_{index}",
+			env:        map[string]string{"BITRISE_GIT_BRANCH": strings.Repeat("b", 80)},
+			index:      5,
+			deviceName: "pixel",
+			want:       strings.Repeat("b", 56) + "_5_pixel",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"BITRISE_APP_SLUG", "BITRISE_BUILD_NUMBER", "BITRISE_GIT_BRANCH", "BITRISE_TRIGGERED_WORKFLOW_ID"} {
+				t.Setenv(key, tt.env[key])
+			}
+			names, err := newNameTemplate(tt.template, time.Unix(0, 1700000000000000000))
+			if err != nil {
+				t.Fatalf("got error %s", err)
+			}
+
+			got := names.render(tt.index, tt.recipeName, tt.deviceName)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if len(got) > maxInstanceNameLength {
+				t.Errorf("got %d characters, want at most %d", len(got), maxInstanceNameLength)
+			}
+		})
+	}
+}
+
+func TestNewNameTemplateUnknownPlaceholder(t *testing.T) {
+	_, err := newNameTemplate("bitrise_{job}_{index}", time.Now())
+	if err == nil || !strings.Contains(err.Error(), "unknown placeholders {job}") {
+		t.Fatalf("got error %v, want the unknown placeholder", err)
+	}
+}
+
+func TestCheckUniqueNames(t *testing.T) {
+	entries := []recipeEntry{{UUID: testRecipe1, Count: 2, Recipe: Recipe{NAME: "Google Pixel 7"}}, {UUID: testRecipe2, Count: 1, Recipe: Recipe{NAME: "Google Pixel 8"}}}
+	tests := []struct {
+		template string
+		wantErr  string
+	}{
+		{template: "bitrise_{index}"},
+		{template: "{recipe_name}-{index}"},
+		{template: "bitrise", wantErr: "instances #0 and #1 are both named bitrise"},
+		{template: "{recipe_name}", wantErr: "instances #0 and #1 are both named Google-Pixel-7"},
+		{template: "{branch}", wantErr: "instance #0 has an empty name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			t.Setenv("BITRISE_GIT_BRANCH", "")
+			names, err := newNameTemplate(tt.template, time.Now())
+			if err != nil {
+				t.Fatalf("got error %s", err)
+			}
+
+			err = checkUniqueNames(instanceSpecs(entries, nil, names, false, 0))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("got error %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
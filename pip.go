@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pipOptions tell pip, or uv, where to get gmsaas from when PyPI can't be reached.
+// Index URLs may hold credentials, they are passed through the environment so that they never show up in logs.
+type pipOptions struct {
+	IndexURL       string
+	ExtraIndexURLs []string
+	TrustedHosts   []string
+	// Wheel is a gmsaas wheel installed instead of the gmsaas_version requirement.
+	Wheel string
+	// FindLinks is a directory of wheels, it is the only source of packages when NoIndex is set.
+	FindLinks string
+	NoIndex   bool
+	// HashesFile is a requirements file pinning gmsaas and its dependencies with their hashes.
+	HashesFile string
+}
+
+// parseLines splits value on commas and new lines.
+func parseLines(value string) []string {
+	return parseList(strings.Replace(value, "\n", ",", -1))
+}
+
+// newPipOptions checks the pip inputs. A wheel path, a `.whl` file or a directory of wheels,
+// replaces PyPI unless an index URL is given too.
+func newPipOptions(indexURL, extraIndexURLs, trustedHosts, wheelPath, hashesFile string) (pipOptions, error) {
+	opts := pipOptions{
+		IndexURL:       strings.TrimSpace(indexURL),
+		ExtraIndexURLs: parseLines(extraIndexURLs),
+		TrustedHosts:   parseLines(trustedHosts),
+		HashesFile:     strings.TrimSpace(hashesFile),
+	}
+
+	if wheelPath = strings.TrimSpace(wheelPath); wheelPath != "" {
+		info, err := os.Stat(wheelPath)
+		switch {
+		case err != nil:
+			return pipOptions{}, fmt.Errorf("gmsaas_wheel_path: %s doesn't exist", wheelPath)
+		case info.IsDir():
+			opts.FindLinks = wheelPath
+		case strings.HasSuffix(wheelPath, ".whl"):
+			opts.Wheel = wheelPath
+			opts.FindLinks = filepath.Dir(wheelPath)
+		default:
+			return pipOptions{}, fmt.Errorf("gmsaas_wheel_path: %s is neither a .whl file nor a directory", wheelPath)
+		}
+		opts.NoIndex = opts.IndexURL == "" && len(opts.ExtraIndexURLs) == 0
+	}
+
+	if opts.HashesFile != "" {
+		if err := checkHashesFile(opts.HashesFile); err != nil {
+			return pipOptions{}, fmt.Errorf("gmsaas_hashes_file: %s", err)
+		}
+	}
+	return opts, nil
+}
+
+// checkHashesFile makes sure pth is a requirements file pinning gmsaas with hashes,
+// as generated by `pip-compile --generate-hashes`.
+func checkHashesFile(pth string) error {
+	file, err := os.Open(pth)
+	if err != nil {
+		return fmt.Errorf("failed to read %s, error: %s", pth, err)
+	}
+	defer file.Close()
+
+	content := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// Requirements are usually split on several lines, one per hash.
+		if strings.HasSuffix(line, "\\") {
+			content += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		content += line + "\n"
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s, error: %s", pth, err)
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(strings.ToLower(line), "gmsaas==") {
+			if !strings.Contains(line, "--hash=") {
+				return fmt.Errorf("%s pins gmsaas without its hashes", pth)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s doesn't pin gmsaas, like gmsaas==1.11.0 --hash=sha256:...", pth)
+}
+
+// env returns the index URLs for pip and uv.
+func (o pipOptions) env() []string {
+	env := []string{}
+	if o.IndexURL != "" {
+		env = append(env, "PIP_INDEX_URL="+o.IndexURL, "UV_INDEX_URL="+o.IndexURL)
+	}
+	if len(o.ExtraIndexURLs) > 0 {
+		urls := strings.Join(o.ExtraIndexURLs, " ")
+		env = append(env, "PIP_EXTRA_INDEX_URL="+urls, "UV_EXTRA_INDEX_URL="+urls)
+	}
+	return env
+}
+
+// options returns the pip options, uv naming trusted hosts insecure hosts.
+func (o pipOptions) options(uv bool) []string {
+	args := []string{}
+	for _, host := range o.TrustedHosts {
+		if uv {
+			args = append(args, "--allow-insecure-host", host)
+		} else {
+			args = append(args, "--trusted-host", host)
+		}
+	}
+	if o.FindLinks != "" {
+		args = append(args, "--find-links", o.FindLinks)
+	}
+	if o.NoIndex {
+		args = append(args, "--no-index")
+	}
+	return args
+}
+
+// packages returns what to install: the hashes file, the wheel or requirement.
+func (o pipOptions) packages(requirement string) []string {
+	switch {
+	case o.HashesFile != "":
+		return []string{"--require-hashes", "-r", o.HashesFile}
+	case o.Wheel != "":
+		return []string{o.Wheel}
+	default:
+		return []string{requirement}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// autoPortsValue is the adb_serial_port value which picks free ports, optionally followed by `:first-last`.
+	autoPortsValue = "auto"
+
+	autoPortsFirst = 42000
+	autoPortsLast  = 42999
+
+	// portLockMaxAge is the age after which a port lock file is considered abandoned.
+	portLockMaxAge = 30 * time.Minute
+)
+
+// portAllocator picks free localhost ports in [First, Last]. A picked port is held by a lock file,
+// shared by every step run on the machine, until the ADB tunnel is bound to it.
+type portAllocator struct {
+	First int
+	Last  int
+
+	dir string
+	mu  sync.Mutex
+}
+
+// parseAutoPorts parses `auto` and `auto:first-last` adb_serial_port values.
+// It returns false when value doesn't ask for automatic ports.
+func parseAutoPorts(value string) (*portAllocator, bool, error) {
+	value = strings.TrimSpace(value)
+	if value != autoPortsValue && !strings.HasPrefix(value, autoPortsValue+":") {
+		return nil, false, nil
+	}
+
+	allocator := &portAllocator{
+		First: autoPortsFirst,
+		Last:  autoPortsLast,
+		dir:   filepath.Join(os.TempDir(), "genymotion-adb-ports"),
+	}
+	if value == autoPortsValue {
+		return allocator, true, nil
+	}
+
+	bounds := strings.SplitN(strings.TrimPrefix(value, autoPortsValue+":"), "-", 2)
+	if len(bounds) != 2 {
+		return nil, true, fmt.Errorf("%s is not a valid port range, expected auto:first-last", value)
+	}
+	var err error
+	if allocator.First, err = parsePort(strings.TrimSpace(bounds[0])); err != nil {
+		return nil, true, err
+	}
+	if allocator.Last, err = parsePort(strings.TrimSpace(bounds[1])); err != nil {
+		return nil, true, err
+	}
+	if allocator.First > allocator.Last {
+		return nil, true, fmt.Errorf("port range %s is reversed", value)
+	}
+	return allocator, true, nil
+}
+
+// Size returns the number of ports in the range.
+func (a *portAllocator) Size() int {
+	return a.Last - a.First + 1
+}
+
+// Acquire picks a free port and locks it. release must be called once the port is bound, or not needed anymore.
+func (a *portAllocator) Acquire() (port string, release func(), err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return "", nil, err
+	}
+	for p := a.First; p <= a.Last; p++ {
+		lock := filepath.Join(a.dir, strconv.Itoa(p)+".lock")
+		if !a.lock(lock) {
+			continue
+		}
+		if !portFree(p) {
+			os.Remove(lock)
+			continue
+		}
+		return strconv.Itoa(p), func() { os.Remove(lock) }, nil
+	}
+	return "", nil, fmt.Errorf("no free port left between %d and %d", a.First, a.Last)
+}
+
+// lock creates the lock file of a port, taking over abandoned ones.
+func (a *portAllocator) lock(pth string) bool {
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(pth, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d", os.Getpid())
+			f.Close()
+			return true
+		}
+		if !os.IsExist(err) || !lockAbandoned(pth) {
+			return false
+		}
+		os.Remove(pth)
+	}
+	return false
+}
+
+// lockAbandoned reports whether the process holding the lock file is gone, or the lock is too old.
+func lockAbandoned(pth string) bool {
+	info, err := os.Stat(pth)
+	if err != nil {
+		return true
+	}
+	if time.Since(info.ModTime()) > portLockMaxAge {
+		return true
+	}
+	data, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return false
+	}
+	return syscall.Kill(pid, 0) == syscall.ESRCH
+}
+
+// portFree reports whether nothing listens on the localhost port.
+func portFree(port int) bool {
+	listener, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
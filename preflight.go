@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxSuggestions is the number of close matches reported for a recipe which doesn't exist.
+const maxSuggestions = 3
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur := make([]int, len(br)+1)
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(br)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// closeRecipes returns the recipes whose key is within maxDistance edits of value, closest first.
+func closeRecipes(recipes []Recipe, value string, key func(Recipe) string, maxDistance int) []Recipe {
+	type candidate struct {
+		recipe   Recipe
+		distance int
+	}
+	candidates := []candidate{}
+	value = strings.ToLower(value)
+	for _, recipe := range recipes {
+		k := strings.ToLower(key(recipe))
+		distance := levenshtein(value, k)
+		if strings.Contains(k, value) || strings.Contains(value, k) {
+			distance = 0
+		}
+		if distance <= maxDistance {
+			candidates = append(candidates, candidate{recipe, distance})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+
+	matches := []Recipe{}
+	for i := 0; i < len(candidates) && i < maxSuggestions; i++ {
+		matches = append(matches, candidates[i].recipe)
+	}
+	return matches
+}
+
+// suggestRecipes describes the recipes close to a missing one: a UUID with a typo,
+// or a name selector spelled differently than in the catalogue.
+func suggestRecipes(recipes []Recipe, entry recipeEntry) string {
+	var matches []Recipe
+	if entry.Selector == nil {
+		matches = closeRecipes(recipes, entry.UUID, func(r Recipe) string { return r.UUID }, 4)
+	} else {
+		for _, term := range entry.Selector {
+			if term.Key == "name" && term.Op != "!=" {
+				matches = closeRecipes(recipes, term.Value, func(r Recipe) string { return r.NAME }, len(term.Value)/3)
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean:\n%s", describeRecipes(matches))
+}
+
+// findRecipe looks for uuid in the catalogue accessible to the account.
+func findRecipe(recipes []Recipe, uuid string) (Recipe, bool) {
+	for _, recipe := range recipes {
+		if strings.EqualFold(recipe.UUID, uuid) {
+			return recipe, true
+		}
+	}
+	return Recipe{}, false
+}
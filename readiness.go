@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// readinessCheck is a condition polled over ADB until it is met.
+// An optional check is only waited for optionalCheckTimeout, the instance being ready without it.
+type readinessCheck struct {
+	Name     string
+	Args     []string
+	Ready    func(output string) bool
+	Optional bool
+}
+
+// optionalCheckTimeout bounds the wait for optional readiness checks.
+const optionalCheckTimeout = 30 * time.Second
+
+// readinessChecks are the conditions an instance must meet, in order, to be considered ready.
+var readinessChecks = []readinessCheck{
+	{
+		Name:  "sys.boot_completed",
+		Args:  []string{"getprop", "sys.boot_completed"},
+		Ready: func(output string) bool { return output == "1" },
+	},
+	{
+		Name:  "dev.bootcomplete",
+		Args:  []string{"getprop", "dev.bootcomplete"},
+		Ready: func(output string) bool { return output == "1" },
+	},
+	{
+		Name:  "package manager",
+		Args:  []string{"pm", "path", "android"},
+		Ready: func(output string) bool { return strings.HasPrefix(output, "package:") },
+	},
+	// System dialogs and home apps without "launcher" in their package name never match, so this is best-effort.
+	{
+		Name:     "launcher idle",
+		Args:     []string{"dumpsys", "window", "windows"},
+		Ready:    launcherFocused,
+		Optional: true,
+	},
+}
+
+// launcherFocused reports whether the focused window, from `dumpsys window windows`, belongs to a launcher.
+func launcherFocused(output string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "mCurrentFocus=") {
+			return strings.Contains(strings.ToLower(line), "launcher")
+		}
+	}
+	return false
+}
+
+// waitForBoot polls the instance connected on serial until every readiness check is met, or ctx is done.
+func waitForBoot(ctx context.Context, adb ADB, serial string, interval time.Duration) error {
+	for _, check := range readinessChecks {
+		checkCtx, cancel := ctx, context.CancelFunc(func() {})
+		if check.Optional {
+			checkCtx, cancel = context.WithTimeout(ctx, optionalCheckTimeout)
+		}
+		err := pollCheck(checkCtx, adb, serial, check, interval)
+		cancel()
+		switch {
+		case err == nil:
+			log.Debugf("%s: %s", serial, check.Name)
+		case check.Optional && ctx.Err() == nil:
+			log.Warnf("%s: %s not met after %s, considered ready anyway", serial, check.Name, optionalCheckTimeout)
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// pollCheck polls check until it is met, or ctx is done.
+func pollCheck(ctx context.Context, adb ADB, serial string, check readinessCheck, interval time.Duration) error {
+	for {
+		output, err := adb.Shell(ctx, serial, check.Args...)
+		if err == nil && check.Ready(output) {
+			return nil
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return fmt.Errorf("%s is not ready, still waiting for %s: %w", serial, check.Name, ctx.Err())
+		}
+	}
+}
+
+// systemServerPID returns the pid of the Android framework, empty while it is down.
+func systemServerPID(ctx context.Context, adb ADB, serial string) string {
+	pid, err := adb.Shell(ctx, serial, "pidof", "system_server")
+	if err != nil {
+		return ""
+	}
+	return pid
+}
+
+// setLocale switches the system locale of the instance connected on serial, eg. `fr-FR`,
+// and restarts the Android framework so that it is applied.
+// It returns once the framework has actually gone down: sys.boot_completed and dev.bootcomplete
+// survive a restart, so checking them right away could report the instance ready mid-restart.
+func setLocale(ctx context.Context, adb ADB, serial, locale string) error {
+	tag := strings.Replace(locale, "_", "-", 1)
+	if _, err := adb.Shell(ctx, serial, "setprop", "persist.sys.locale", tag); err != nil {
+		return fmt.Errorf("failed to set locale %s, error: %s", tag, err)
+	}
+	pid := systemServerPID(ctx, adb, serial)
+	if _, err := adb.Shell(ctx, serial, "setprop", "ctl.restart", "zygote"); err != nil {
+		return fmt.Errorf("failed to restart the Android framework, error: %s", err)
+	}
+	// Without pidof, the package manager becoming unavailable tells the framework is down,
+	// which may be missed when the restart is quick, so it is only waited for a while.
+	down := func() bool { return systemServerPID(ctx, adb, serial) != pid }
+	waitCtx, cancel := ctx, context.CancelFunc(func() {})
+	if pid == "" {
+		down = func() bool {
+			_, err := adb.Shell(ctx, serial, "pm", "path", "android")
+			return err != nil
+		}
+		waitCtx, cancel = context.WithTimeout(ctx, optionalCheckTimeout)
+	}
+	defer cancel()
+	for !down() {
+		select {
+		case <-time.After(restartPollInterval):
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return fmt.Errorf("%s: the Android framework didn't restart: %w", serial, ctx.Err())
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// restartPollInterval is the delay between two checks of the framework restart, which is quick.
+const restartPollInterval = 200 * time.Millisecond
+
+// prepareInstance waits for the instance of spec to be booted and sets its locale, when required.
+// Setting a locale restarts the Android framework, so it waits for it to go down and be booted again.
+func prepareInstance(ctx context.Context, adb ADB, spec instanceSpec, serial string) error {
+	log.Infof("Wait for instance %s to be booted on %s", spec.Name, serial)
+	if err := waitForBoot(ctx, adb, serial, bootPollInterval); err != nil {
+		return err
+	}
+	if spec.Locale == "" {
+		return nil
+	}
+
+	log.Infof("Set locale %s on instance %s", spec.Locale, spec.Name)
+	if err := setLocale(ctx, adb, serial, spec.Locale); err != nil {
+		return err
+	}
+	return waitForBoot(ctx, adb, serial, bootPollInterval)
+}
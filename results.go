@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Phase is the last phase an instance reached while being provisioned.
+type Phase string
+
+// Provisioning phases, in order.
+const (
+	PhaseStart   Phase = "start"
+	PhaseConnect Phase = "connect"
+	PhaseReady   Phase = "ready"
+	PhaseDone    Phase = "done"
+)
+
+// InstanceResult is the outcome of starting and connecting one instance.
+type InstanceResult struct {
+	Index      int
+	RecipeUUID string
+	Name       string
+	UUID       string
+	ADBSerial  string
+	Phase      Phase
+	Err        error
+	TimedOut   bool
+	Duration   time.Duration
+
+	// StartedAt, ConnectedAt and ReadyAt are the times each phase completed at.
+	StartedAt   time.Time
+	ConnectedAt time.Time
+	ReadyAt     time.Time
+}
+
+// Succeeded reports whether the instance has been started, connected and is ready when required.
+func (r InstanceResult) Succeeded() bool {
+	return r.Err == nil && r.Phase == PhaseDone
+}
+
+// failedResults returns the results of the instances which couldn't be provisioned.
+func failedResults(results []InstanceResult) []InstanceResult {
+	failed := []InstanceResult{}
+	for _, result := range results {
+		if !result.Succeeded() {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// resultsError aggregates the errors of all failed instances into a per-instance summary,
+// it returns nil when every instance succeeded.
+func resultsError(results []InstanceResult) error {
+	failed := failedResults(results)
+	if len(failed) == 0 {
+		return nil
+	}
+
+	lines := []string{fmt.Sprintf("%d of %d instances failed:", len(failed), len(results))}
+	for _, result := range failed {
+		uuid := result.UUID
+		if uuid == "" {
+			uuid = "-"
+		}
+		status := "failed"
+		if result.TimedOut {
+			status = "timed out"
+		}
+		lines = append(lines, fmt.Sprintf("- #%d %s | recipe: %s | instance: %s | phase: %s | %s after %s | error: %s",
+			result.Index, result.Name, result.RecipeUUID, uuid, result.Phase, status, result.Duration.Round(time.Second), result.Err))
+	}
+	return errors.New(strings.Join(lines, "\n"))
+}
+
+// parseMinInstances converts the min_instances input, an absolute count or a percentage like `80%`,
+// into the number of instances out of total which must succeed. All of them when value is empty.
+func parseMinInstances(value string, total int) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return total, nil
+	}
+
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "%")), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, fmt.Errorf("min_instances: %s is not a percentage between 0 and 100", value)
+		}
+		return int(math.Ceil(float64(total) * percent / 100)), nil
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("min_instances: %s is neither a positive count nor a percentage", value)
+	}
+	if count > total {
+		return 0, fmt.Errorf("min_instances: %d is greater than the number of instances to start (%d)", count, total)
+	}
+	return count, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMinInstances(t *testing.T) {
+	tests := []struct {
+		value   string
+		total   int
+		want    int
+		wantErr string
+	}{
+		{value: "", total: 4, want: 4},
+		{value: " 2 ", total: 4, want: 2},
+		{value: "4", total: 4, want: 4},
+		{value: "5", total: 4, wantErr: "5 is greater than the number of instances to start (4)"},
+		{value: "0", total: 4, wantErr: "0 is neither a positive count nor a percentage"},
+		{value: "-1", total: 4, wantErr: "-1 is neither a positive count nor a percentage"},
+		{value: "two", total: 4, wantErr: "two is neither a positive count nor a percentage"},
+		{value: "50%", total: 4, want: 2},
+		{value: "50%", total: 3, want: 2},
+		{value: "34%", total: 3, want: 2},
+		{value: "33.3%", total: 3, want: 1},
+		{value: "1%", total: 10, want: 1},
+		{value: "100%", total: 7, want: 7},
+		{value: "0%", total: 4, wantErr: "0% is not a percentage between 0 and 100"},
+		{value: "101%", total: 4, wantErr: "101% is not a percentage between 0 and 100"},
+		{value: "half%", total: 4, wantErr: "half% is not a percentage between 0 and 100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseMinInstances(tt.value, tt.total)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
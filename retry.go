@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"regexp"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	retryBaseDelay = 5 * time.Second
+	retryMaxDelay  = 60 * time.Second
+)
+
+// Messages used to tell transient errors from permanent ones. gmsaas exit codes like API_ERROR or ADB_ERROR
+// are catch-alls for both, so only the message is trusted.
+var (
+	permanentMessage = regexp.MustCompile(`(?i)not found|does not exist|invalid|forbidden|unauthorized|permission|not allowed|quota exceeded|license`)
+	transientMessage = regexp.MustCompile(`(?i)timed? ?out|temporar|unavailable|try again|too many requests|rate limit|capacity|connection (reset|refused|aborted)|not ready|\b50[234]\b|\b429\b`)
+)
+
+// isTransient reports whether err is worth retrying: a timeout of the attempt itself,
+// a 429/5xx from the API, or a gmsaas error whose output looks temporary.
+func isTransient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == 429 || apiErr.StatusCode >= 500
+	}
+
+	var gmsaasErr *gmsaasError
+	if errors.As(err, &gmsaasErr) {
+		// Permanent messages win, wherever they are found.
+		output := gmsaasErr.Message + "\n" + gmsaasErr.Output
+		return !permanentMessage.MatchString(output) && transientMessage.MatchString(output)
+	}
+	return false
+}
+
+// backoff returns the delay to wait before the nth retry: exponential, capped, with jitter.
+func backoff(retry int) time.Duration {
+	delay := retryMaxDelay
+	if retry < 8 {
+		delay = retryBaseDelay << uint(retry-1)
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retry calls fn until it succeeds, fails with an error which is not transient, or retries are exhausted.
+// fn gets the attempt number, starting at 1.
+func retry(ctx context.Context, what string, retries int, fn func(attempt int) error) error {
+	for attempt := 1; ; attempt++ {
+		if retries > 0 {
+			log.Infof("%s: attempt %d/%d", what, attempt, retries+1)
+		}
+		err := fn(attempt)
+		if err == nil {
+			return nil
+		}
+		if attempt > retries || ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+
+		delay := backoff(attempt)
+		log.Warnf("%s: attempt %d/%d failed with a transient error, retrying in %s: %s", what, attempt, retries+1, delay.Round(time.Millisecond), err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
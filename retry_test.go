@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "deadline exceeded", err: fmt.Errorf("instances start aborted: %w", context.DeadlineExceeded), want: true},
+		{name: "canceled", err: context.Canceled, want: false},
+		{name: "plain error", err: errors.New("connection reset"), want: false},
+		{name: "API 429", err: &apiError{StatusCode: 429}, want: true},
+		{name: "API 500", err: &apiError{StatusCode: 500}, want: true},
+		{name: "API 503", err: fmt.Errorf("start failed: %w", &apiError{StatusCode: 503}), want: true},
+		{name: "API 400", err: &apiError{StatusCode: 400}, want: false},
+		{name: "API 401", err: &apiError{StatusCode: 401}, want: false},
+		{name: "API 404", err: &apiError{StatusCode: 404, Body: "service unavailable"}, want: false},
+		{name: "gmsaas timeout message", err: &gmsaasError{ExitCode: 4, Message: "Request timed out"}, want: true},
+		{name: "gmsaas rate limit message", err: &gmsaasError{ExitCode: 4, Message: "Too many requests, try again later"}, want: true},
+		{name: "gmsaas 503 in output", err: &gmsaasError{ExitCode: 4, Output: "Error: 503 Service Unavailable"}, want: true},
+		{name: "gmsaas connection refused", err: &gmsaasError{ExitCode: 5, Message: "adb: connection refused"}, want: true},
+		{name: "gmsaas not found message", err: &gmsaasError{ExitCode: 4, Message: "Recipe not found"}, want: false},
+		{name: "gmsaas unauthorized with transient output", err: &gmsaasError{ExitCode: 4, Message: "Unauthorized", Output: "request timed out"}, want: false},
+		{name: "gmsaas permanent output with transient words", err: &gmsaasError{ExitCode: 4, Output: "Error: invalid recipe, the request timed out with 503"}, want: false},
+		{name: "gmsaas unknown message", err: &gmsaasError{ExitCode: 4, Message: "Something went wrong"}, want: false},
+		{name: "gmsaas API_ERROR exit code alone", err: &gmsaasError{ExitCode: 4, ExitCodeDesc: "API_ERROR"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransient(tt.err); got != tt.want {
+				t.Errorf("got %t, want %t for %v", got, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{retry: 1, min: 2500 * time.Millisecond, max: 5 * time.Second},
+		{retry: 2, min: 5 * time.Second, max: 10 * time.Second},
+		{retry: 3, min: 10 * time.Second, max: 20 * time.Second},
+		{retry: 4, min: 20 * time.Second, max: 40 * time.Second},
+		{retry: 5, min: 30 * time.Second, max: retryMaxDelay},
+		{retry: 8, min: 30 * time.Second, max: retryMaxDelay},
+		{retry: 100, min: 30 * time.Second, max: retryMaxDelay},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.retry), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if delay := backoff(tt.retry); delay < tt.min || delay > tt.max {
+					t.Fatalf("got %s, want between %s and %s", delay, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Values of the on_partial_failure input.
+const (
+	OnPartialFailureRollback = "rollback"
+	OnPartialFailureKeep     = "keep"
+)
+
+// rollback stops, in parallel, every instance started by this run, including the ones which
+// failed after being created. It returns the UUIDs of the instances which couldn't be stopped.
+func rollback(client GMSaaS, results []InstanceResult) []string {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	leaked := []string{}
+	for _, result := range results {
+		if result.UUID == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(result InstanceResult) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), gmsaasCallTimeout)
+			defer cancel()
+			if err := client.StopInstance(ctx, result.UUID); err != nil {
+				log.Errorf("Failed to stop instance %s (%s), error: %s", result.UUID, result.Name, err)
+				mu.Lock()
+				leaked = append(leaked, result.UUID)
+				mu.Unlock()
+				return
+			}
+			log.Infof("Instance %s (%s) has been stopped", result.UUID, result.Name)
+		}(result)
+	}
+	wg.Wait()
+	return leaked
+}
+
+// rollbackFailures applies on_partial_failure once every instance has been attempted. With rollback,
+// the failed instances are stopped when at least minInstances succeeded, every instance otherwise.
+// It reports whether the threshold is met and which instances, by UUID, have been stopped.
+func rollbackFailures(client GMSaaS, results []InstanceResult, onPartialFailure string, minInstances int) (bool, map[string]bool) {
+	failed := failedResults(results)
+	thresholdMet := len(results)-len(failed) >= minInstances
+	rolledBack := map[string]bool{}
+	if len(failed) == 0 || onPartialFailure != OnPartialFailureRollback {
+		return thresholdMet, rolledBack
+	}
+
+	toStop := failed
+	if !thresholdMet {
+		log.Warnf("Roll back: stop every instance started by this run")
+		toStop = results
+	} else {
+		log.Warnf("Stop the instances which failed to start or connect")
+	}
+	leaked := rollback(client, toStop)
+	if len(leaked) > 0 {
+		printError("Failed to stop instances, please stop them manually: %s", strings.Join(leaked, ","))
+	}
+	for _, result := range toStop {
+		rolledBack[result.UUID] = result.UUID != ""
+	}
+	for _, uuid := range leaked {
+		rolledBack[uuid] = false
+	}
+	return thresholdMet, rolledBack
+}
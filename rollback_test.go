@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRollbackFailures(t *testing.T) {
+	tests := []struct {
+		name             string
+		onPartialFailure string
+		minInstances     int
+		stopErr          error
+		wantThresholdMet bool
+		wantStopped      []string
+		wantRolledBack   map[string]bool
+	}{
+		{
+			name:             "threshold met, only the failed instances are stopped",
+			onPartialFailure: OnPartialFailureRollback,
+			minInstances:     2,
+			wantThresholdMet: true,
+			wantStopped:      []string{"fake-instance-2"},
+			wantRolledBack:   map[string]bool{"fake-instance-2": true, "": false},
+		},
+		{
+			name:             "threshold missed, every instance is stopped",
+			onPartialFailure: OnPartialFailureRollback,
+			minInstances:     3,
+			wantThresholdMet: false,
+			wantStopped:      []string{"fake-instance-0", "fake-instance-1", "fake-instance-2"},
+			wantRolledBack:   map[string]bool{"fake-instance-0": true, "fake-instance-1": true, "fake-instance-2": true, "": false},
+		},
+		{
+			name:             "keep, nothing is stopped",
+			onPartialFailure: OnPartialFailureKeep,
+			minInstances:     3,
+			wantThresholdMet: false,
+			wantStopped:      []string{},
+			wantRolledBack:   map[string]bool{},
+		},
+		{
+			name:             "instances which can't be stopped aren't rolled back",
+			onPartialFailure: OnPartialFailureRollback,
+			minInstances:     2,
+			stopErr:          errors.New("gmsaas instances stop failed"),
+			wantThresholdMet: true,
+			wantStopped:      []string{"fake-instance-2"},
+			wantRolledBack:   map[string]bool{"fake-instance-2": false, "": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeGMSaaS()
+			results := []InstanceResult{}
+			for i := 0; i < 3; i++ {
+				instance, err := client.StartInstance(context.Background(), testRecipe1, "bitrise")
+				if err != nil {
+					t.Fatal(err)
+				}
+				results = append(results, InstanceResult{Index: i, UUID: instance.UUID, Phase: PhaseDone})
+			}
+			// The third instance failed to connect, a fourth one failed to start.
+			results[2].Phase, results[2].Err = PhaseConnect, errors.New("adbconnect failed")
+			results = append(results, InstanceResult{Index: 3, Phase: PhaseStart, Err: errors.New("start failed")})
+			client.StopErr = tt.stopErr
+
+			thresholdMet, rolledBack := rollbackFailures(client, results, tt.onPartialFailure, tt.minInstances)
+			if thresholdMet != tt.wantThresholdMet {
+				t.Errorf("threshold met: got %t, want %t", thresholdMet, tt.wantThresholdMet)
+			}
+			if !reflect.DeepEqual(rolledBack, tt.wantRolledBack) {
+				t.Errorf("rolled back: got %v, want %v", rolledBack, tt.wantRolledBack)
+			}
+			stopped := []string{}
+			for _, call := range client.Calls {
+				if strings.HasPrefix(call, "instances stop ") {
+					stopped = append(stopped, strings.TrimPrefix(call, "instances stop "))
+				}
+			}
+			sort.Strings(stopped)
+			if !reflect.DeepEqual(stopped, tt.wantStopped) {
+				t.Errorf("stopped: got %q, want %q", stopped, tt.wantStopped)
+			}
+		})
+	}
+}
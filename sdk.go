@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+// sdkCandidate is a possible Android SDK location and where it comes from.
+type sdkCandidate struct {
+	Path   string
+	Source string
+}
+
+// defaultSDKPaths are the usual Android SDK locations of Android Studio, Homebrew and CI images.
+func defaultSDKPaths() []string {
+	home := pathutil.UserHomeDir()
+	return []string{
+		filepath.Join(home, "Library", "Android", "sdk"),
+		filepath.Join(home, "Android", "Sdk"),
+		"/usr/local/lib/android/sdk",
+		"/usr/local/share/android-sdk",
+		"/opt/homebrew/share/android-commandlinetools",
+		"/opt/android-sdk",
+		"/opt/android-sdk-linux",
+	}
+}
+
+// sdkFromPATH returns the SDK whose platform-tools hold the adb found on PATH, symlinks resolved.
+func sdkFromPATH() (string, bool) {
+	adb, err := exec.LookPath("adb")
+	if err != nil {
+		return "", false
+	}
+	if resolved, err := filepath.EvalSymlinks(adb); err == nil {
+		adb = resolved
+	}
+	platformTools := filepath.Dir(adb)
+	if filepath.Base(platformTools) != "platform-tools" {
+		return "", false
+	}
+	return filepath.Dir(platformTools), true
+}
+
+// checkADB makes sure the SDK at sdkPath holds a platform-tools/adb which runs.
+func checkADB(sdkPath string) error {
+	bin := filepath.Join(sdkPath, "platform-tools", "adb")
+	info, err := os.Stat(bin)
+	if err != nil {
+		return fmt.Errorf("%s doesn't exist", bin)
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", bin)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, bin, "version").CombinedOutput(); err != nil {
+		return fmt.Errorf("%s version failed, error: %s | output: %s", bin, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// findAndroidSDK looks for an Android SDK with a usable adb in the android_sdk_path input, ANDROID_HOME,
+// ANDROID_SDK_ROOT, the SDK of the adb on PATH and then the default locations, in that order.
+// An explicit android_sdk_path must be usable, the other sources are skipped when they aren't.
+func findAndroidSDK(explicit string) (sdkCandidate, error) {
+	if explicit != "" {
+		if err := checkADB(explicit); err != nil {
+			return sdkCandidate{}, fmt.Errorf("android_sdk_path: %s is not a usable Android SDK, error: %s", explicit, err)
+		}
+		return sdkCandidate{Path: explicit, Source: "android_sdk_path input"}, nil
+	}
+
+	candidates := []sdkCandidate{}
+	for _, env := range []string{"ANDROID_HOME", "ANDROID_SDK_ROOT"} {
+		if value := os.Getenv(env); value != "" {
+			candidates = append(candidates, sdkCandidate{Path: value, Source: env})
+		}
+	}
+	if sdkPath, ok := sdkFromPATH(); ok {
+		candidates = append(candidates, sdkCandidate{Path: sdkPath, Source: "adb on PATH"})
+	}
+	for _, sdkPath := range defaultSDKPaths() {
+		candidates = append(candidates, sdkCandidate{Path: sdkPath, Source: "default location"})
+	}
+
+	tried := []string{}
+	for _, candidate := range candidates {
+		err := checkADB(candidate.Path)
+		if err == nil {
+			return candidate, nil
+		}
+		if candidate.Source != "default location" {
+			log.Warnf("Ignore the Android SDK of %s (%s): %s", candidate.Source, candidate.Path, err)
+		}
+		tried = append(tried, fmt.Sprintf("- %s (%s): %s", candidate.Path, candidate.Source, err))
+	}
+	return sdkCandidate{}, fmt.Errorf("no Android SDK with a usable platform-tools/adb found, set the android_sdk_path input or ANDROID_HOME, tried:\n%s", strings.Join(tried, "\n"))
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+var selectorTermPattern = regexp.MustCompile(`^\s*([a-z_]+)\s*(>=|<=|!=|~=|=|>|<)\s*(.*?)\s*$`)
+
+// selectorOperators lists the operators each selector key supports.
+var selectorOperators = map[string][]string{
+	"name":    {"=", "!=", "~="},
+	"android": {"=", "!=", ">=", "<=", ">", "<"},
+	"form":    {"=", "!="},
+	"source":  {"=", "!="},
+	// hwprofile and osimage select the two halves of a recipe, created when it doesn't exist.
+	"hwprofile": {"="},
+	"osimage":   {"="},
+}
+
+// selectorTerm is one `key<op>value` condition of a recipe selector, like `android>=13`.
+type selectorTerm struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+// recipeSelector selects recipes meeting all its terms, like `android=14,form=tablet`.
+type recipeSelector []selectorTerm
+
+// isSelectorTerm reports whether item looks like a `key<op>value` selector term rather than a recipe UUID.
+func isSelectorTerm(item string) bool {
+	return selectorTermPattern.MatchString(item)
+}
+
+// parseSelectorTerm parses and checks a `key<op>value` selector term.
+func parseSelectorTerm(item string) (selectorTerm, error) {
+	match := selectorTermPattern.FindStringSubmatch(item)
+	if match == nil {
+		return selectorTerm{}, fmt.Errorf("%s is neither a recipe UUID nor a selector like name=Google Pixel 7", item)
+	}
+	term := selectorTerm{Key: match[1], Op: match[2], Value: match[3]}
+
+	ops, ok := selectorOperators[term.Key]
+	if !ok {
+		return term, fmt.Errorf("%s: unknown selector key %s, must be one of name, android, form, source, hwprofile, osimage", item, term.Key)
+	}
+	supported := false
+	for _, op := range ops {
+		supported = supported || op == term.Op
+	}
+	if !supported {
+		return term, fmt.Errorf("%s: %s only supports %s", item, term.Key, strings.Join(ops, " "))
+	}
+	if term.Value == "" {
+		return term, fmt.Errorf("%s: missing value", item)
+	}
+	if term.Key == "form" && term.Value != "phone" && term.Value != "tablet" {
+		return term, fmt.Errorf("%s: form must be phone or tablet", item)
+	}
+	return term, nil
+}
+
+func (s recipeSelector) String() string {
+	terms := []string{}
+	for _, term := range s {
+		terms = append(terms, term.Key+term.Op+term.Value)
+	}
+	return strings.Join(terms, ",")
+}
+
+// recipeForm returns `tablet` for recipes whose smallest screen width is at least 600dp, `phone` otherwise.
+func recipeForm(recipe Recipe) string {
+	if recipe.SCREEN_DENSITY <= 0 {
+		return ""
+	}
+	smallest := recipe.SCREEN_WIDTH
+	if recipe.SCREEN_HEIGHT < smallest {
+		smallest = recipe.SCREEN_HEIGHT
+	}
+	if smallest*160/recipe.SCREEN_DENSITY >= 600 {
+		return "tablet"
+	}
+	return "phone"
+}
+
+func (t selectorTerm) matches(recipe Recipe) bool {
+	switch t.Key {
+	case "android":
+		if recipe.ANDROID_VERSION == "" {
+			return false
+		}
+		cmp := compareVersions(recipe.ANDROID_VERSION, t.Value)
+		switch t.Op {
+		case "=":
+			return cmp == 0
+		case "!=":
+			return cmp != 0
+		case ">=":
+			return cmp >= 0
+		case "<=":
+			return cmp <= 0
+		case ">":
+			return cmp > 0
+		case "<":
+			return cmp < 0
+		}
+		return false
+	case "name":
+		if t.Op == "~=" {
+			return strings.Contains(strings.ToLower(recipe.NAME), strings.ToLower(t.Value))
+		}
+		return strings.EqualFold(recipe.NAME, t.Value) == (t.Op == "=")
+	case "form":
+		return (recipeForm(recipe) == t.Value) == (t.Op == "=")
+	case "source":
+		return strings.EqualFold(recipe.SOURCE, t.Value) == (t.Op == "=")
+	}
+	return false
+}
+
+// Matches reports whether recipe meets every term of the selector.
+func (s recipeSelector) Matches(recipe Recipe) bool {
+	for _, term := range s {
+		if !term.matches(recipe) {
+			return false
+		}
+	}
+	return true
+}
+
+// describeRecipes formats recipes for error messages, one per line.
+func describeRecipes(recipes []Recipe) string {
+	lines := []string{}
+	for _, recipe := range recipes {
+		lines = append(lines, fmt.Sprintf("  %s | %s | Android %s | %s", recipe.UUID, recipe.NAME, recipe.ANDROID_VERSION, recipeForm(recipe)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// listRecipesRetries is the number of retries of the recipe listing of the pre-flight check.
+const listRecipesRetries = 2
+
+// resolveRecipes checks every entry against the recipe catalogue of the account before anything is started:
+// UUIDs must exist, selectors are replaced by the UUID of the single recipe they match.
+// `hwprofile=...,osimage=...` selectors reuse the recipe made of them, or create it once every entry is known to be valid.
+// The catalogue is listed with retries, nothing is started when it still can't be fetched.
+// It returns a copy of entries whose UUIDs are all set, and the recipes it created.
+func resolveRecipes(ctx context.Context, client GMSaaS, entries []recipeEntry) ([]recipeEntry, []Recipe, error) {
+	var recipes []Recipe
+	err := retry(ctx, "List recipes", listRecipesRetries, func(int) error {
+		listCtx, cancel := context.WithTimeout(ctx, gmsaasCallTimeout)
+		defer cancel()
+		var err error
+		recipes, err = client.ListRecipes(listCtx)
+		return err
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list recipes, their existence can't be checked before starting instances, error: %s", err)
+	}
+	catalog := &recipeCatalog{client: client, recipes: recipes}
+
+	resolved := []recipeEntry{}
+	problems := []string{}
+	for _, entry := range entries {
+		if entry.Selector == nil {
+			recipe, found := findRecipe(recipes, entry.UUID)
+			if !found {
+				problems = append(problems, fmt.Sprintf("recipe %s doesn't exist or isn't accessible to this account%s", entry.UUID, suggestRecipes(recipes, entry)))
+			}
+			entry.Recipe = recipe
+			resolved = append(resolved, entry)
+			continue
+		}
+		if _, _, ok := entry.Selector.combination(); ok {
+			if _, _, err := catalog.lookup(ctx, entry.Selector); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", entry.Selector, err))
+			}
+			resolved = append(resolved, entry)
+			continue
+		}
+
+		matches := []Recipe{}
+		for _, recipe := range recipes {
+			if entry.Selector.Matches(recipe) {
+				matches = append(matches, recipe)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			if suggestions := suggestRecipes(recipes, entry); suggestions != "" {
+				problems = append(problems, fmt.Sprintf("%s matches no recipe%s", entry.Selector, suggestions))
+			} else {
+				problems = append(problems, fmt.Sprintf("%s matches no recipe, available recipes:\n%s", entry.Selector, describeRecipes(recipes)))
+			}
+		case 1:
+			log.Infof("Recipe selector %s resolved to %s (%s)", entry.Selector, matches[0].UUID, matches[0].NAME)
+			entry.UUID = matches[0].UUID
+			entry.Recipe = matches[0]
+			resolved = append(resolved, entry)
+		default:
+			problems = append(problems, fmt.Sprintf("%s is ambiguous, it matches %d recipes:\n%s", entry.Selector, len(matches), describeRecipes(matches)))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, nil, errors.New("failed to resolve recipes:\n- " + strings.Join(problems, "\n- "))
+	}
+
+	for i, entry := range resolved {
+		if _, _, ok := entry.Selector.combination(); !ok {
+			continue
+		}
+		recipe, err := catalog.recipeFor(ctx, entry.Selector)
+		if err != nil {
+			return nil, catalog.created, fmt.Errorf("failed to resolve recipes:\n- %s: %s", entry.Selector, err)
+		}
+		resolved[i].UUID = recipe.UUID
+		resolved[i].Recipe = recipe
+	}
+	return resolved, catalog.created, nil
+}
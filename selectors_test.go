@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSelectorTerm(t *testing.T) {
+	tests := []struct {
+		item    string
+		want    selectorTerm
+		wantErr string
+	}{
+		{item: "android=14", want: selectorTerm{Key: "android", Op: "=", Value: "14"}},
+		{item: " android >= 13 ", want: selectorTerm{Key: "android", Op: ">=", Value: "13"}},
+		{item: "android<12.1", want: selectorTerm{Key: "android", Op: "<", Value: "12.1"}},
+		{item: "name=Google Pixel 7", want: selectorTerm{Key: "name", Op: "=", Value: "Google Pixel 7"}},
+		{item: "name~=pixel", want: selectorTerm{Key: "name", Op: "~=", Value: "pixel"}},
+		{item: "form!=tablet", want: selectorTerm{Key: "form", Op: "!=", Value: "tablet"}},
+		{item: "source=genymotion", want: selectorTerm{Key: "source", Op: "=", Value: "genymotion"}},
+		{item: "not a selector", wantErr: "is neither a recipe UUID nor a selector"},
+		{item: "color=red", wantErr: "unknown selector key color"},
+		{item: "name>=Pixel", wantErr: "name only supports = != ~="},
+		{item: "android~=14", wantErr: "android only supports = != >= <= > <"},
+		{item: "android=", wantErr: "missing value"},
+		{item: "form=watch", wantErr: "form must be phone or tablet"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.item, func(t *testing.T) {
+			term, err := parseSelectorTerm(tt.item)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %s", err)
+			}
+			if term != tt.want {
+				t.Errorf("got %+v, want %+v", term, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecipeSelectorMatches(t *testing.T) {
+	pixel := Recipe{NAME: "Google Pixel 7", ANDROID_VERSION: "14.0", SCREEN_WIDTH: 1080, SCREEN_HEIGHT: 2400, SCREEN_DENSITY: 420, SOURCE: "genymotion"}
+	tablet := Recipe{NAME: "Samsung Galaxy Tab S8", ANDROID_VERSION: "12.1", SCREEN_WIDTH: 1600, SCREEN_HEIGHT: 2560, SCREEN_DENSITY: 320, SOURCE: "user"}
+	unknown := Recipe{NAME: "Custom"}
+
+	tests := []struct {
+		selector string
+		recipe   Recipe
+		want     bool
+	}{
+		{selector: "android=14", recipe: pixel, want: true},
+		{selector: "android=14.0.0", recipe: pixel, want: true},
+		{selector: "android>12.1", recipe: tablet, want: false},
+		{selector: "android>=12.1", recipe: tablet, want: true},
+		{selector: "android<13", recipe: tablet, want: true},
+		{selector: "android!=14", recipe: pixel, want: false},
+		{selector: "android>=1", recipe: unknown, want: false},
+		{selector: "name=google pixel 7", recipe: pixel, want: true},
+		{selector: "name!=Google Pixel 7", recipe: pixel, want: false},
+		{selector: "name~=PIXEL", recipe: pixel, want: true},
+		{selector: "form=phone", recipe: pixel, want: true},
+		{selector: "form=tablet", recipe: tablet, want: true},
+		{selector: "form!=phone", recipe: unknown, want: true},
+		{selector: "source=Genymotion", recipe: pixel, want: true},
+		{selector: "android=14,form=phone", recipe: pixel, want: true},
+		{selector: "android=14,form=tablet", recipe: pixel, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector+"/"+tt.recipe.NAME, func(t *testing.T) {
+			entries, problems := parseRecipeEntries(tt.selector)
+			if len(problems) > 0 || len(entries) != 1 {
+				t.Fatalf("invalid selector %s: %q", tt.selector, problems)
+			}
+			if got := entries[0].Selector.Matches(tt.recipe); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRecipeEntriesSelectors(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        string
+		want         []string
+		wantProblems []string
+	}{
+		{name: "commas join terms", value: "android=14,form=tablet", want: []string{"android=14,form=tablet:1"}},
+		{name: "semicolons split selectors", value: "android=14;form=tablet", want: []string{"android=14:1", "form=tablet:1"}},
+		{name: "new lines split selectors", value: "android=14\nform=tablet", want: []string{"android=14:1", "form=tablet:1"}},
+		{name: "count applies to the whole selector", value: "android=14,form=tablet:2", want: []string{"android=14,form=tablet:2"}},
+		{name: "count ends a selector", value: "android=14:2,form=tablet", want: []string{"android=14:2", "form=tablet:1"}},
+		{name: "counts of each group", value: "android=14,form=phone:2; name~=Tab:3", want: []string{"android=14,form=phone:2", "name~=Tab:3"}},
+		{name: "UUID ends a selector", value: "android=14," + testRecipe1 + ":2,form=phone", want: []string{"android=14:1", testRecipe1 + ":2", "form=phone:1"}},
+		{name: "hwprofile with osimage", value: "hwprofile=Pixel 7,osimage=Android 14.0", want: []string{"hwprofile=Pixel 7,osimage=Android 14.0:1"}},
+		{name: "hwprofile alone", value: "hwprofile=Pixel 7", want: []string{"hwprofile=Pixel 7:1"}, wantProblems: []string{
+			"recipe_uuid: hwprofile=Pixel 7: hwprofile and osimage must be given together, without other keys",
+		}},
+		{name: "invalid term", value: "android=14,form=watch", want: []string{"android=14:1"}, wantProblems: []string{
+			"recipe_uuid: form=watch: form must be phone or tablet",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, problems := parseRecipeEntries(tt.value)
+			if got := describeEntries(entries); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entries: got %q, want %q", got, tt.want)
+			}
+			if len(problems) != len(tt.wantProblems) || (len(problems) > 0 && !reflect.DeepEqual(problems, tt.wantProblems)) {
+				t.Errorf("problems: got %q, want %q", problems, tt.wantProblems)
+			}
+		})
+	}
+}
+
+func TestResolveRecipesReusesCreatedRecipe(t *testing.T) {
+	client := newFakeGMSaaS()
+	client.HWProfiles = []HWProfile{{UUID: "b1c7a0d2-0000-4000-8000-000000000007", NAME: "Google Pixel 7", DISPLAY_WIDTH: 1080, DISPLAY_HEIGHT: 2400, DISPLAY_DENSITY: 420}}
+	client.OSImages = []OSImage{{UUID: "c0e1a0d2-0000-4000-8000-000000000014", NAME: "Android 14.0", OS_VERSION: "14.0"}}
+	entries, problems := parseRecipeEntries("hwprofile=Google Pixel 7,osimage=14")
+	if len(problems) > 0 {
+		t.Fatalf("invalid entries: %q", problems)
+	}
+
+	// Two builds resolving the same combination, the second one must find the recipe created by the first.
+	uuids := []string{}
+	for build := 0; build < 2; build++ {
+		resolved, _, err := resolveRecipes(context.Background(), client, entries)
+		if err != nil {
+			t.Fatalf("build %d: got error %s", build, err)
+		}
+		uuids = append(uuids, resolved[0].UUID)
+	}
+
+	creates := 0
+	for _, call := range client.Calls {
+		if strings.HasPrefix(call, "recipes create") {
+			creates++
+		}
+	}
+	if creates != 1 {
+		t.Errorf("got %d recipes created, want 1: %q", creates, client.Calls)
+	}
+	if uuids[0] == "" || uuids[0] != uuids[1] {
+		t.Errorf("got recipes %q, want the same recipe for both builds", uuids)
+	}
+}
@@ -0,0 +1,125 @@
+// Command adb is a stub of the adb `shell` commands used by the step to check that instances are booted
+// and to set their locale, `setprop` always succeeds. `adb version` reports a fixed version.
+//
+// Each device reports itself booted ADB_SIM_BOOT_DELAY (default: 0s) after it has first been queried,
+// first query times are kept in ADB_SIM_STATE_DIR (default: the temporary directory).
+// When ADB_SIM_SCENARIO is never_ready, devices never finish booting, when it is no_launcher,
+// a system dialog keeps the focus instead of the launcher.
+//
+// `setprop ctl.restart zygote` restarts the framework: it keeps running for one more second, as on a real
+// device, then is down for ADB_SIM_RESTART_DELAY (default: 3s) and comes back with a new system_server pid.
+// sys.boot_completed and dev.bootcomplete are not reset by a restart.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 1 && args[0] == "version" {
+		fmt.Println("Android Debug Bridge version 1.0.41")
+		return
+	}
+	if len(args) < 4 || args[0] != "-s" || args[2] != "shell" {
+		fmt.Fprintf(os.Stderr, "usage: adb version | adb -s SERIAL shell COMMAND...\n")
+		os.Exit(1)
+	}
+	serial, shell := args[1], strings.Join(args[3:], " ")
+
+	booted := os.Getenv("ADB_SIM_SCENARIO") != "never_ready" && since(serial) >= bootDelay()
+	restarted, sinceRestart := restartedSince(serial)
+	frameworkUp := booted && (!restarted || sinceRestart < time.Second || sinceRestart >= time.Second+restartDelay())
+	switch {
+	case shell == "getprop sys.boot_completed", shell == "getprop dev.bootcomplete":
+		if booted {
+			fmt.Println("1")
+		} else {
+			fmt.Println("")
+		}
+	case shell == "pm path android":
+		if !frameworkUp {
+			fmt.Fprintln(os.Stderr, "Error: Could not access the Package Manager. Is the system running?")
+			os.Exit(1)
+		}
+		fmt.Println("package:/system/framework/framework-res.apk")
+	case shell == "dumpsys window windows":
+		if frameworkUp && os.Getenv("ADB_SIM_SCENARIO") == "no_launcher" {
+			fmt.Println("  mCurrentFocus=Window{7c1d0e2 u0 Application Not Responding: com.android.systemui}")
+		} else if frameworkUp {
+			fmt.Println("  mCurrentFocus=Window{5e3a2b1 u0 com.android.launcher3/com.android.launcher3.Launcher}")
+		} else {
+			fmt.Println("  mCurrentFocus=null")
+		}
+	case shell == "pidof system_server":
+		if !frameworkUp {
+			os.Exit(1)
+		}
+		if restarted && sinceRestart >= time.Second {
+			fmt.Println("2345")
+		} else {
+			fmt.Println("1234")
+		}
+	case shell == "setprop ctl.restart zygote":
+		if err := ioutil.WriteFile(statePath(serial)+"-restart", nil, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to restart: %s\n", err)
+			os.Exit(1)
+		}
+	case strings.HasPrefix(shell, "setprop "):
+	default:
+		fmt.Fprintf(os.Stderr, "unsupported command: %s\n", shell)
+		os.Exit(1)
+	}
+}
+
+func bootDelay() time.Duration {
+	delay, err := time.ParseDuration(os.Getenv("ADB_SIM_BOOT_DELAY"))
+	if err != nil {
+		return 0
+	}
+	return delay
+}
+
+func restartDelay() time.Duration {
+	delay, err := time.ParseDuration(os.Getenv("ADB_SIM_RESTART_DELAY"))
+	if err != nil {
+		return 3 * time.Second
+	}
+	return delay
+}
+
+// statePath returns the path of the file whose modification time is the first query time of serial.
+func statePath(serial string) string {
+	dir := os.Getenv("ADB_SIM_STATE_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "adb-sim-"+strings.NewReplacer(":", "_", "/", "_").Replace(serial))
+}
+
+// restartedSince returns whether the framework of serial has been restarted, and how long ago.
+func restartedSince(serial string) (bool, time.Duration) {
+	info, err := os.Stat(statePath(serial) + "-restart")
+	if err != nil {
+		return false, 0
+	}
+	return true, time.Since(info.ModTime())
+}
+
+// since returns the time elapsed since the device has first been queried.
+func since(serial string) time.Duration {
+	pth := statePath(serial)
+	if info, err := os.Stat(pth); err == nil {
+		return time.Since(info.ModTime())
+	}
+	if err := ioutil.WriteFile(pth, nil, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write %s: %s\n", pth, err)
+		os.Exit(1)
+	}
+	return 0
+}
@@ -0,0 +1,41 @@
+// Command envman is a stub of the envman `add` command used by the step to export its outputs.
+// Every exported `KEY=value` line is appended to the file pointed by ENVMAN_STUB_FILE
+// (default: envman-stub.env in the temporary directory).
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	args := os.Args[1:]
+	if len(args) != 3 || args[0] != "add" || args[1] != "--key" {
+		fmt.Fprintf(os.Stderr, "usage: envman add --key KEY < value\n")
+		os.Exit(1)
+	}
+
+	value, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read value: %s\n", err)
+		os.Exit(1)
+	}
+
+	pth := os.Getenv("ENVMAN_STUB_FILE")
+	if pth == "" {
+		pth = filepath.Join(os.TempDir(), "envman-stub.env")
+	}
+	f, err := os.OpenFile(pth, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open %s: %s\n", pth, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "%s=%s\n", args[2], value); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write %s: %s\n", pth, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,458 @@
+// Command gmsaas simulates the gmsaas command line tool, so that the step can be run
+// end to end without a Genymotion Cloud SaaS account.
+//
+// State is kept in the JSON file pointed by GMSAAS_SIM_STATE (default: gmsaas-sim-state.json
+// in the temporary directory) so that several invocations, possibly concurrent, share instances.
+//
+// Hardware profiles and OS images can be combined into new recipes with recipes create, they are kept in the state too.
+//
+// GMSAAS_SIM_SCENARIO is a comma separated list of:
+//   - slow_boot: instances start takes GMSAAS_SIM_BOOT_DELAY (default: 30s)
+//   - start_failure: instances start fails for recipes in GMSAAS_SIM_FAIL_RECIPES, or all when empty
+//   - connect_failure: instances adbconnect fails for instances of recipes in GMSAAS_SIM_FAIL_RECIPES, or all when empty
+//   - flaky_start: the first GMSAAS_SIM_FLAKY_ATTEMPTS (default: 1) starts of every instance name
+//     fail with a transient error, leaving a half-created instance behind
+//   - flaky_connect: the first GMSAAS_SIM_FLAKY_ATTEMPTS adbconnect of every instance fail with a transient error
+//   - auth_failure: auth token and auth login fail
+//   - malformed_json: json outputs are truncated
+//   - stderr_warnings: a warning is printed on stderr before every output
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const version = "1.11.0"
+
+// Exit codes returned by the simulator.
+const (
+	exitGeneric = 1
+	exitUsage   = 2
+	exitAuth    = 3
+	exitAPI     = 4
+	exitADB     = 5
+)
+
+type instance struct {
+	UUID          string `json:"uuid"`
+	Name          string `json:"name"`
+	State         string `json:"state"`
+	ADBSerial     string `json:"adb_serial"`
+	ADBSerialPort int    `json:"adb_serial_port"`
+	Recipe        recipe `json:"recipe"`
+	CreatedAt     string `json:"created_at"`
+}
+
+// recipe is printed like gmsaas does, with its hardware profile and OS image nested.
+type recipe struct {
+	UUID            string    `json:"uuid"`
+	Name            string    `json:"name"`
+	Source          string    `json:"source"`
+	HardwareProfile hwprofile `json:"hardware_profile"`
+	OSImage         osimage   `json:"os_image"`
+}
+
+type hwprofile struct {
+	UUID           string `json:"uuid"`
+	Name           string `json:"name"`
+	DisplayWidth   int    `json:"display_width"`
+	DisplayHeight  int    `json:"display_height"`
+	DisplayDensity int    `json:"display_density"`
+	Source         string `json:"source"`
+}
+
+type osimage struct {
+	UUID      string `json:"uuid"`
+	Name      string `json:"name"`
+	OSVersion string `json:"os_version"`
+	APILevel  int    `json:"api_level"`
+	Source    string `json:"source"`
+}
+
+type state struct {
+	Config    map[string]string `json:"config"`
+	Instances []instance        `json:"instances"`
+	NextPort  int               `json:"next_port"`
+	Counter   int               `json:"counter"`
+	Attempts  map[string]int    `json:"attempts"`
+	// Recipes holds the recipes created with recipes create.
+	Recipes []recipe `json:"recipes"`
+}
+
+var hwprofiles = []hwprofile{
+	{"b1c7a0d2-0000-4000-8000-000000000007", "Google Pixel 7", 1080, 2400, 420, "genymotion"},
+	{"b1c7a0d2-0000-4000-8000-000000000008", "Google Pixel 8", 1080, 2400, 420, "genymotion"},
+	{"b1c7a0d2-0000-4000-8000-0000000000a8", "Samsung Galaxy Tab S8", 1600, 2560, 320, "genymotion"},
+	{"b1c7a0d2-0000-4000-8000-000000000003", "Google Pixel 3", 1080, 2160, 440, "genymotion"},
+}
+
+var osimages = []osimage{
+	{"c0e1a0d2-0000-4000-8000-000000000010", "Android 10.0", "10.0", 29, "genymotion"},
+	{"c0e1a0d2-0000-4000-8000-000000000012", "Android 12.0", "12.0", 31, "genymotion"},
+	{"c0e1a0d2-0000-4000-8000-000000000013", "Android 13.0", "13.0", 33, "genymotion"},
+	{"c0e1a0d2-0000-4000-8000-000000000014", "Android 14.0", "14.0", 34, "genymotion"},
+}
+
+var recipes = []recipe{
+	{"e20da1a3-313c-434a-9d43-7268b12fee08", "Google Pixel 7", "genymotion", hwprofiles[0], osimages[2]},
+	{"c52fdfc2-6914-4266-aa6e-50258f50ef91", "Google Pixel 8", "genymotion", hwprofiles[1], osimages[3]},
+	{"06867de4-4b99-4842-ba40-fd3daaabdf23", "Samsung Galaxy Tab S8", "genymotion", hwprofiles[2], osimages[1]},
+	{"a0e0b6f4-0f29-4b2a-9b6c-6f4a1d0e2c11", "Google Pixel 3", "genymotion", hwprofiles[3], osimages[0]},
+}
+
+// allRecipes returns the base recipes followed by the created ones.
+func allRecipes() []recipe {
+	all := append([]recipe(nil), recipes...)
+	update(func(s *state) { all = append(all, s.Recipes...) })
+	return all
+}
+
+var (
+	format    = "text"
+	scenarios = map[string]bool{}
+)
+
+func main() {
+	for _, s := range strings.Split(os.Getenv("GMSAAS_SIM_SCENARIO"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			scenarios[s] = true
+		}
+	}
+
+	args := os.Args[1:]
+	if len(args) >= 2 && args[0] == "--format" {
+		format = args[1]
+		args = args[2:]
+	}
+	if len(args) == 1 && args[0] == "--version" {
+		fmt.Printf("gmsaas version %s\n", version)
+		return
+	}
+	if scenarios["stderr_warnings"] {
+		fmt.Fprintln(os.Stderr, "WARNING: a new version of gmsaas is available, please upgrade.")
+	}
+
+	switch command(args) {
+	case "auth token", "auth login":
+		if scenarios["auth_failure"] {
+			fail(exitAuth, "AUTHENTICATION_ERROR", "Invalid credentials")
+		}
+		output(map[string]interface{}{"auth": map[string]string{"email": "bitrise@example.com"}}, "User logged in")
+	case "config set":
+		need(args, 4)
+		update(func(s *state) { s.Config[args[2]] = args[3] })
+		output(map[string]interface{}{"config": map[string]string{args[2]: args[3]}}, args[2]+" set")
+	case "recipes list":
+		output(map[string]interface{}{"recipes": allRecipes()}, "")
+	case "recipes create":
+		need(args, 5)
+		createRecipe(args[2], args[3], args[4])
+	case "recipes delete":
+		need(args, 3)
+		var deleted *recipe
+		update(func(s *state) {
+			for i := range s.Recipes {
+				if s.Recipes[i].UUID == args[2] {
+					r := s.Recipes[i]
+					deleted = &r
+					s.Recipes = append(s.Recipes[:i], s.Recipes[i+1:]...)
+					return
+				}
+			}
+		})
+		if deleted == nil {
+			fail(exitAPI, "RECIPE_NOT_FOUND", "Recipe "+args[2]+" not found")
+		}
+		output(map[string]interface{}{"recipe": deleted}, deleted.UUID)
+	case "hwprofiles list":
+		output(map[string]interface{}{"hwprofiles": hwprofiles}, "")
+	case "osimages list":
+		output(map[string]interface{}{"osimages": osimages}, "")
+	case "instances start":
+		need(args, 4)
+		start(args[2], args[3])
+	case "instances adbconnect":
+		need(args, 3)
+		adbconnect(args[2], args[3:])
+	case "instances get":
+		need(args, 3)
+		var found *instance
+		update(func(s *state) { found = find(s, args[2]) })
+		if found == nil {
+			fail(exitAPI, "INSTANCE_NOT_FOUND", "Instance "+args[2]+" not found")
+		}
+		output(map[string]interface{}{"instance": found}, found.UUID)
+	case "instances list":
+		var instances []instance
+		update(func(s *state) { instances = s.Instances })
+		output(map[string]interface{}{"instances": instances}, "")
+	case "instances stop":
+		need(args, 3)
+		var stopped *instance
+		update(func(s *state) {
+			if stopped = find(s, args[2]); stopped != nil {
+				stopped.State = "DELETED"
+				stopped.ADBSerial = ""
+			}
+		})
+		if stopped == nil {
+			fail(exitAPI, "INSTANCE_NOT_FOUND", "Instance "+args[2]+" not found")
+		}
+		output(map[string]interface{}{"instance": stopped}, stopped.UUID)
+	default:
+		fail(exitUsage, "USAGE_ERROR", fmt.Sprintf("No such command: %s", strings.Join(args, " ")))
+	}
+}
+
+func command(args []string) string {
+	if len(args) < 2 {
+		return strings.Join(args, " ")
+	}
+	return args[0] + " " + args[1]
+}
+
+func need(args []string, n int) {
+	if len(args) < n {
+		fail(exitUsage, "USAGE_ERROR", "Missing argument")
+	}
+}
+
+func createRecipe(hwprofileUUID, osimageUUID, name string) {
+	var hw *hwprofile
+	for i := range hwprofiles {
+		if hwprofiles[i].UUID == hwprofileUUID {
+			hw = &hwprofiles[i]
+		}
+	}
+	var image *osimage
+	for i := range osimages {
+		if osimages[i].UUID == osimageUUID {
+			image = &osimages[i]
+		}
+	}
+	if hw == nil || image == nil {
+		fail(exitAPI, "NOT_FOUND", "Hardware profile "+hwprofileUUID+" or OS image "+osimageUUID+" not found")
+	}
+
+	var created recipe
+	update(func(s *state) {
+		s.Counter++
+		created = recipe{
+			UUID:            fmt.Sprintf("7ec1be00-0000-4000-8000-%012d", s.Counter),
+			Name:            name,
+			Source:          "user",
+			HardwareProfile: *hw,
+			OSImage:         *image,
+		}
+		s.Recipes = append(s.Recipes, created)
+	})
+	output(map[string]interface{}{"recipe": created}, created.UUID)
+}
+
+func start(recipeUUID, name string) {
+	var r *recipe
+	all := allRecipes()
+	for i := range all {
+		if all[i].UUID == recipeUUID {
+			r = &all[i]
+		}
+	}
+	if r == nil {
+		fail(exitAPI, "RECIPE_NOT_FOUND", "Recipe "+recipeUUID+" not found")
+	}
+	if scenarios["start_failure"] && matches(os.Getenv("GMSAAS_SIM_FAIL_RECIPES"), recipeUUID) {
+		fail(exitAPI, "INSTANCE_START_FAILED", "Unable to start instance "+name)
+	}
+	if scenarios["flaky_start"] && flaky("start "+name) {
+		update(func(s *state) {
+			s.Counter++
+			s.Instances = append(s.Instances, instance{
+				UUID:      fmt.Sprintf("5b8a6c2e-0000-4000-8000-%012d", s.Counter),
+				Name:      name,
+				State:     "CREATING",
+				Recipe:    *r,
+				CreatedAt: time.Now().UTC().Format(time.RFC3339),
+			})
+		})
+		fail(exitAPI, "SERVICE_UNAVAILABLE", "Service temporarily unavailable (503), please try again later")
+	}
+	if scenarios["slow_boot"] {
+		delay, err := time.ParseDuration(os.Getenv("GMSAAS_SIM_BOOT_DELAY"))
+		if err != nil {
+			delay = 30 * time.Second
+		}
+		time.Sleep(delay)
+	}
+
+	var started instance
+	update(func(s *state) {
+		s.Counter++
+		started = instance{
+			UUID:      fmt.Sprintf("5b8a6c2e-0000-4000-8000-%012d", s.Counter),
+			Name:      name,
+			State:     "ONLINE",
+			Recipe:    *r,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		}
+		s.Instances = append(s.Instances, started)
+	})
+	output(map[string]interface{}{"instance": started}, started.UUID)
+}
+
+func adbconnect(instanceUUID string, flags []string) {
+	recipeUUID := ""
+	update(func(s *state) {
+		if i := find(s, instanceUUID); i != nil {
+			recipeUUID = i.Recipe.UUID
+		}
+	})
+	if scenarios["connect_failure"] && matches(os.Getenv("GMSAAS_SIM_FAIL_RECIPES"), recipeUUID) {
+		fail(exitADB, "ADB_CONNECT_FAILED", "Unable to connect instance "+instanceUUID+" to ADB")
+	}
+	if scenarios["flaky_connect"] && flaky("adbconnect "+instanceUUID) {
+		fail(exitADB, "ADB_TUNNEL_NOT_READY", "ADB tunnel is not ready yet for instance "+instanceUUID)
+	}
+	port := 0
+	if len(flags) == 2 && flags[0] == "--adb-serial-port" {
+		if _, err := fmt.Sscanf(flags[1], "%d", &port); err != nil {
+			fail(exitUsage, "USAGE_ERROR", "Invalid value for --adb-serial-port: "+flags[1])
+		}
+	}
+
+	var connected *instance
+	update(func(s *state) {
+		if connected = find(s, instanceUUID); connected == nil {
+			return
+		}
+		if port == 0 {
+			if s.NextPort == 0 {
+				s.NextPort = 40000
+			}
+			port = s.NextPort
+			s.NextPort++
+		}
+		connected.ADBSerialPort = port
+		connected.ADBSerial = fmt.Sprintf("localhost:%d", port)
+	})
+	if connected == nil {
+		fail(exitAPI, "INSTANCE_NOT_FOUND", "Instance "+instanceUUID+" not found")
+	}
+	output(map[string]interface{}{"instance": connected}, connected.ADBSerial)
+}
+
+// flaky reports whether the given call should fail, counting its attempts in the state.
+func flaky(call string) bool {
+	attempts, err := strconv.Atoi(os.Getenv("GMSAAS_SIM_FLAKY_ATTEMPTS"))
+	if err != nil {
+		attempts = 1
+	}
+	failing := false
+	update(func(s *state) {
+		if s.Attempts == nil {
+			s.Attempts = map[string]int{}
+		}
+		s.Attempts[call]++
+		failing = s.Attempts[call] <= attempts
+	})
+	return failing
+}
+
+func find(s *state, instanceUUID string) *instance {
+	for i := range s.Instances {
+		if s.Instances[i].UUID == instanceUUID {
+			return &s.Instances[i]
+		}
+	}
+	return nil
+}
+
+func matches(list, value string) bool {
+	if list == "" {
+		return true
+	}
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// update loads the state, applies fn and saves it back, under an exclusive file lock.
+func update(fn func(s *state)) {
+	pth := os.Getenv("GMSAAS_SIM_STATE")
+	if pth == "" {
+		pth = filepath.Join(os.TempDir(), "gmsaas-sim-state.json")
+	}
+
+	lock, err := os.OpenFile(pth+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		fail(exitGeneric, "SIMULATOR_ERROR", err.Error())
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		fail(exitGeneric, "SIMULATOR_ERROR", err.Error())
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	s := state{Config: map[string]string{}}
+	if data, err := ioutil.ReadFile(pth); err == nil {
+		if err := json.Unmarshal(data, &s); err != nil {
+			fail(exitGeneric, "SIMULATOR_ERROR", err.Error())
+		}
+	}
+	fn(&s)
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		fail(exitGeneric, "SIMULATOR_ERROR", err.Error())
+	}
+	if err := ioutil.WriteFile(pth, data, 0644); err != nil {
+		fail(exitGeneric, "SIMULATOR_ERROR", err.Error())
+	}
+}
+
+func output(data map[string]interface{}, text string) {
+	if format != "json" {
+		if text != "" {
+			fmt.Println(text)
+		}
+		return
+	}
+	data["exit_code"] = 0
+	data["exit_code_desc"] = "NO_ERROR"
+	out, _ := json.MarshalIndent(data, "", "    ")
+	if scenarios["malformed_json"] {
+		out = out[:len(out)/2]
+	}
+	fmt.Println(string(out))
+}
+
+var exitCodeDescs = map[int]string{
+	exitGeneric: "GENERIC_ERROR",
+	exitUsage:   "USAGE_ERROR",
+	exitAuth:    "AUTHENTICATION_ERROR",
+	exitAPI:     "API_ERROR",
+	exitADB:     "ADB_ERROR",
+}
+
+func fail(code int, errorCode, message string) {
+	if format == "json" {
+		out, _ := json.MarshalIndent(map[string]interface{}{
+			"error":          map[string]string{"code": errorCode, "message": message},
+			"exit_code":      code,
+			"exit_code_desc": exitCodeDescs[code],
+		}, "", "    ")
+		fmt.Println(string(out))
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", message)
+	}
+	os.Exit(code)
+}
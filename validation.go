@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	uuidPattern  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	countPattern = regexp.MustCompile(`^(.*?)\s*:\s*(-?\d+)$`)
+)
+
+// parseList splits a comma separated input, trimming entries and dropping empty ones.
+func parseList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// recipeEntry is one entry of recipe_uuid or of the devices file: a recipe UUID, or a selector resolved
+// against the recipe catalogue, and the number of instances to start from it.
+// The other settings can only be given by a devices file, zero values meaning the inputs apply.
+type recipeEntry struct {
+	UUID     string
+	Selector recipeSelector
+	Count    int
+	// Recipe is the catalogue entry of the recipe, once resolved.
+	Recipe Recipe
+
+	Ports       []string
+	Name        string
+	Locale      string
+	WaitForBoot *bool
+	BootTimeout int
+}
+
+func (e recipeEntry) String() string {
+	if e.Selector != nil {
+		return e.Selector.String()
+	}
+	return e.UUID
+}
+
+// instanceCount returns the number of instances to start for entries.
+func instanceCount(entries []recipeEntry) int {
+	count := 0
+	for _, entry := range entries {
+		count += entry.Count
+	}
+	return count
+}
+
+// splitCount splits the `:N` instance count suffix off item, the count is 1 when there is none.
+func splitCount(item string) (string, int, error) {
+	match := countPattern.FindStringSubmatch(item)
+	if match == nil {
+		return item, 1, nil
+	}
+	count, err := strconv.Atoi(match[2])
+	if err != nil || count < 1 {
+		return item, 0, fmt.Errorf("%s: instance count must be a positive number", item)
+	}
+	return match[1], count, nil
+}
+
+// parseRecipeEntries parses recipe_uuid. Entries are separated by commas, consecutive selector terms
+// being one selector: `android=14,form=tablet`. Two selectors in a row are separated by `;` or a new line.
+// An entry ending with `:N` starts N instances, eg. `android=14,form=tablet:2`, and ends a selector.
+// Every problem found is returned.
+func parseRecipeEntries(value string) ([]recipeEntry, []string) {
+	entries := []recipeEntry{}
+	problems := []string{}
+	for _, group := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '\n' }) {
+		var selector recipeSelector
+		flush := func(count int) {
+			if selector != nil {
+				if err := checkCombination(selector); err != nil {
+					problems = append(problems, "recipe_uuid: "+err.Error())
+				}
+				entries = append(entries, recipeEntry{Selector: selector, Count: count})
+				selector = nil
+			}
+		}
+		for _, raw := range parseList(group) {
+			item, count, err := splitCount(raw)
+			if err != nil {
+				problems = append(problems, "recipe_uuid: "+err.Error())
+				continue
+			}
+
+			if !isSelectorTerm(item) {
+				flush(1)
+				if !uuidPattern.MatchString(item) {
+					problems = append(problems, fmt.Sprintf("recipe_uuid: %s is neither a valid UUID nor a selector like name=Google Pixel 7", item))
+				}
+				entries = append(entries, recipeEntry{UUID: item, Count: count})
+				continue
+			}
+			term, err := parseSelectorTerm(item)
+			if err != nil {
+				problems = append(problems, "recipe_uuid: "+err.Error())
+				continue
+			}
+			selector = append(selector, term)
+			if item != raw {
+				flush(count)
+			}
+		}
+		flush(1)
+	}
+	return entries, problems
+}
+
+// parsePort checks that value is a valid TCP port.
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%s is not a valid port, must be between 1 and 65535", value)
+	}
+	return port, nil
+}
+
+// parsePorts expands a comma separated list of ports and port ranges like `4321-4325`.
+// Every problem found is returned.
+func parsePorts(value string) ([]string, []string) {
+	ports := []string{}
+	problems := []string{}
+	for _, item := range parseList(value) {
+		bounds := strings.SplitN(item, "-", 2)
+		if len(bounds) == 1 {
+			if _, err := parsePort(item); err != nil {
+				problems = append(problems, "adb_serial_port: "+err.Error())
+				continue
+			}
+			ports = append(ports, item)
+			continue
+		}
+
+		first, err := parsePort(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("adb_serial_port: range %s: %s", item, err))
+			continue
+		}
+		last, err := parsePort(strings.TrimSpace(bounds[1]))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("adb_serial_port: range %s: %s", item, err))
+			continue
+		}
+		if first > last {
+			problems = append(problems, fmt.Sprintf("adb_serial_port: range %s is reversed", item))
+			continue
+		}
+		for port := first; port <= last; port++ {
+			ports = append(ports, strconv.Itoa(port))
+		}
+	}
+	return ports, problems
+}
+
+// validatedInputs are the recipe_uuid and adb_serial_port inputs once checked.
+type validatedInputs struct {
+	Recipes []recipeEntry
+	// Ports holds one port per instance, or none.
+	Ports []string
+	// AutoPorts is set when free ports must be picked at connection time.
+	AutoPorts *portAllocator
+}
+
+// validateInputs checks the recipe_uuid and adb_serial_port inputs before anything is started.
+// It returns the cleaned up recipe and port lists, or an error listing every problem found.
+func validateInputs(recipesValue, portsValue string) (validatedInputs, error) {
+	recipes, problems := parseRecipeEntries(recipesValue)
+	if len(recipes) == 0 && len(problems) == 0 {
+		problems = append(problems, "recipe_uuid: at least one recipe UUID is required")
+	}
+	instances := instanceCount(recipes)
+
+	autoPorts, auto, err := parseAutoPorts(portsValue)
+	if err != nil {
+		problems = append(problems, "adb_serial_port: "+err.Error())
+	} else if auto && autoPorts.Size() < instances {
+		problems = append(problems, fmt.Sprintf("adb_serial_port: range %d-%d is too small for %d instances", autoPorts.First, autoPorts.Last, instances))
+	}
+
+	ports, portProblems := []string{}, []string{}
+	if !auto {
+		ports, portProblems = parsePorts(portsValue)
+	}
+	problems = append(problems, portProblems...)
+	if len(portProblems) == 0 && len(ports) > 0 && len(ports) != instances {
+		problems = append(problems, fmt.Sprintf("adb_serial_port: %d ports given for %d instances, there must be one port per instance", len(ports), instances))
+	}
+	problems = append(problems, duplicatePorts(ports)...)
+
+	if len(problems) > 0 {
+		return validatedInputs{}, errors.New("invalid inputs:\n- " + strings.Join(problems, "\n- "))
+	}
+	return validatedInputs{Recipes: recipes, Ports: ports, AutoPorts: autoPorts}, nil
+}
+
+// validateDevicesFile loads the devices file and checks it along with the adb_serial_port input,
+// which can only be empty or `auto` since ports are set per device.
+func validateDevicesFile(pth, profile, portsValue string) (validatedInputs, error) {
+	recipes, err := loadDevicesFile(pth, profile)
+	if err != nil {
+		return validatedInputs{}, err
+	}
+
+	problems := []string{}
+	ports := []string{}
+	withoutPort := 0
+	for _, entry := range recipes {
+		if len(entry.Ports) == 0 {
+			withoutPort += entry.Count
+			for n := 0; n < entry.Count; n++ {
+				ports = append(ports, "")
+			}
+			continue
+		}
+		ports = append(ports, entry.Ports...)
+	}
+	problems = append(problems, duplicatePorts(ports)...)
+
+	autoPorts, auto, err := parseAutoPorts(portsValue)
+	switch {
+	case err != nil:
+		problems = append(problems, "adb_serial_port: "+err.Error())
+	case auto && autoPorts.Size() < withoutPort:
+		problems = append(problems, fmt.Sprintf("adb_serial_port: range %d-%d is too small for %d instances", autoPorts.First, autoPorts.Last, withoutPort))
+	case !auto && strings.TrimSpace(portsValue) != "":
+		problems = append(problems, "adb_serial_port: ports are set per device in devices_file, only auto can be used")
+	}
+
+	if len(problems) > 0 {
+		return validatedInputs{}, errors.New("invalid inputs:\n- " + strings.Join(problems, "\n- "))
+	}
+	return validatedInputs{Recipes: recipes, Ports: ports, AutoPorts: autoPorts}, nil
+}
+
+// duplicatePorts reports the ports used more than once, empty ones being ignored.
+func duplicatePorts(ports []string) []string {
+	problems := []string{}
+	seen := map[string]bool{}
+	for _, port := range ports {
+		if port != "" && seen[port] {
+			problems = append(problems, fmt.Sprintf("adb_serial_port: port %s is used more than once", port))
+		}
+		seen[port] = true
+	}
+	return problems
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testRecipe1 = "e20da1a3-313c-434a-9d43-7268b12fee08"
+	testRecipe2 = "c52fdfc2-6914-4266-aa6e-50258f50ef91"
+)
+
+// describeEntries formats entries as `recipe:count` for comparisons.
+func describeEntries(entries []recipeEntry) []string {
+	described := []string{}
+	for _, entry := range entries {
+		described = append(described, fmt.Sprintf("%s:%d", entry, entry.Count))
+	}
+	return described
+}
+
+func TestParseRecipeEntries(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        string
+		want         []string
+		wantProblems []string
+	}{
+		{name: "empty", value: "", want: []string{}},
+		{name: "single UUID", value: testRecipe1, want: []string{testRecipe1 + ":1"}},
+		{name: "whitespace and empty entries", value: "  " + testRecipe1 + " ,, " + testRecipe2 + " ,", want: []string{testRecipe1 + ":1", testRecipe2 + ":1"}},
+		{name: "counts", value: testRecipe1 + ":3," + testRecipe2 + " : 2", want: []string{testRecipe1 + ":3", testRecipe2 + ":2"}},
+		{name: "zero count", value: testRecipe1 + ":0", want: []string{}, wantProblems: []string{"recipe_uuid: " + testRecipe1 + ":0: instance count must be a positive number"}},
+		{name: "negative count", value: testRecipe1 + ":-1", want: []string{}, wantProblems: []string{"recipe_uuid: " + testRecipe1 + ":-1: instance count must be a positive number"}},
+		{name: "invalid UUID", value: "not-a-uuid", want: []string{"not-a-uuid:1"}, wantProblems: []string{"recipe_uuid: not-a-uuid is neither a valid UUID nor a selector like name=Google Pixel 7"}},
+		{name: "new lines", value: testRecipe1 + "\n\n" + testRecipe2 + ":2\n", want: []string{testRecipe1 + ":1", testRecipe2 + ":2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, problems := parseRecipeEntries(tt.value)
+			if got := describeEntries(entries); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entries: got %q, want %q", got, tt.want)
+			}
+			if len(problems) != len(tt.wantProblems) || (len(problems) > 0 && !reflect.DeepEqual(problems, tt.wantProblems)) {
+				t.Errorf("problems: got %q, want %q", problems, tt.wantProblems)
+			}
+		})
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        string
+		want         []string
+		wantProblems []string
+	}{
+		{name: "empty", value: "", want: []string{}},
+		{name: "list", value: "4321,4322", want: []string{"4321", "4322"}},
+		{name: "whitespace", value: " 4321 , 4322 ,", want: []string{"4321", "4322"}},
+		{name: "range", value: "4321-4323", want: []string{"4321", "4322", "4323"}},
+		{name: "range with whitespace", value: "4321 - 4323", want: []string{"4321", "4322", "4323"}},
+		{name: "single port range", value: "4321-4321", want: []string{"4321"}},
+		{name: "ports and ranges", value: "5555,4321-4322", want: []string{"5555", "4321", "4322"}},
+		{name: "reversed range", value: "4323-4321", want: []string{}, wantProblems: []string{"adb_serial_port: range 4323-4321 is reversed"}},
+		{name: "out of range port", value: "0,65536", want: []string{}, wantProblems: []string{
+			"adb_serial_port: 0 is not a valid port, must be between 1 and 65535",
+			"adb_serial_port: 65536 is not a valid port, must be between 1 and 65535",
+		}},
+		{name: "invalid range bound", value: "4321-abc", want: []string{}, wantProblems: []string{"adb_serial_port: range 4321-abc: abc is not a valid port, must be between 1 and 65535"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ports, problems := parsePorts(tt.value)
+			if !reflect.DeepEqual(ports, tt.want) {
+				t.Errorf("ports: got %q, want %q", ports, tt.want)
+			}
+			if len(problems) != len(tt.wantProblems) || (len(problems) > 0 && !reflect.DeepEqual(problems, tt.wantProblems)) {
+				t.Errorf("problems: got %q, want %q", problems, tt.wantProblems)
+			}
+		})
+	}
+}
+
+func TestValidateInputs(t *testing.T) {
+	tests := []struct {
+		name      string
+		recipes   string
+		ports     string
+		wantPorts []string
+		wantErr   string
+	}{
+		{name: "no ports", recipes: testRecipe1 + "," + testRecipe2, wantPorts: []string{}},
+		{name: "one port per instance", recipes: testRecipe1 + ":2," + testRecipe2, ports: "4321-4322, 5555", wantPorts: []string{"4321", "4322", "5555"}},
+		{name: "no recipe", recipes: " , ", wantErr: "recipe_uuid: at least one recipe UUID is required"},
+		{name: "too few ports", recipes: testRecipe1 + ":2", ports: "4321", wantErr: "adb_serial_port: 1 ports given for 2 instances"},
+		{name: "duplicate ports", recipes: testRecipe1 + ":2", ports: "4321,4321", wantErr: "adb_serial_port: port 4321 is used more than once"},
+		{name: "duplicate port in a range", recipes: testRecipe1 + ":3", ports: "4322,4321-4322", wantErr: "adb_serial_port: port 4322 is used more than once"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputs, err := validateInputs(tt.recipes, tt.ports)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %s", err)
+			}
+			if !reflect.DeepEqual(inputs.Ports, tt.wantPorts) {
+				t.Errorf("ports: got %q, want %q", inputs.Ports, tt.wantPorts)
+			}
+		})
+	}
+}
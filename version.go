@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// compareVersions compares dotted numeric versions like `13`, `8.1` or `1.11.0`, missing parts count as 0.
+// It returns -1, 0 or 1. Non numeric parts are compared as strings.
+func compareVersions(a, b string) int {
+	aParts := strings.Split(strings.TrimSpace(a), ".")
+	bParts := strings.Split(strings.TrimSpace(b), ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		aPart, bPart := "0", "0"
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+
+		aNum, aErr := strconv.Atoi(aPart)
+		bNum, bErr := strconv.Atoi(bPart)
+		switch {
+		case aErr == nil && bErr == nil && aNum < bNum:
+			return -1
+		case aErr == nil && bErr == nil && aNum > bNum:
+			return 1
+		case (aErr != nil || bErr != nil) && aPart != bPart:
+			if aPart < bPart {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+var versionConditionPattern = regexp.MustCompile(`^(~=|==|!=|>=|<=|>|<|=)?\s*(\d+(\.\d+)*)$`)
+
+// versionCondition is one comparison of a version constraint, like `>=1.11`.
+type versionCondition struct {
+	Operator string
+	Version  string
+}
+
+// versionConstraint is a comma separated list of conditions, like `>=1.11,<2`, which must all hold.
+// An empty constraint is satisfied by any version.
+type versionConstraint []versionCondition
+
+// parseVersionConstraint parses value, a bare version like `1.11.0` standing for `==1.11.0`.
+func parseVersionConstraint(value string) (versionConstraint, error) {
+	constraint := versionConstraint{}
+	if strings.TrimSpace(value) == "" {
+		return constraint, nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		groups := versionConditionPattern.FindStringSubmatch(strings.TrimSpace(item))
+		if groups == nil {
+			return nil, fmt.Errorf("%s is neither a version nor a constraint like >=1.11,<2", value)
+		}
+		operator := groups[1]
+		if operator == "" || operator == "=" {
+			operator = "=="
+		}
+		if operator == "~=" && !strings.Contains(groups[2], ".") {
+			return nil, fmt.Errorf("%s: ~= requires at least two version parts, like ~=1.11", value)
+		}
+		constraint = append(constraint, versionCondition{Operator: operator, Version: groups[2]})
+	}
+	return constraint, nil
+}
+
+// satisfiedBy reports whether version meets every condition of c.
+func (c versionConstraint) satisfiedBy(version string) bool {
+	for _, condition := range c {
+		cmp := compareVersions(version, condition.Version)
+		ok := false
+		switch condition.Operator {
+		case "==":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case ">=":
+			ok = cmp >= 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case "<":
+			ok = cmp < 0
+		case "~=":
+			// ~=1.11 means >=1.11 and 1.*, ~=1.11.2 means >=1.11.2 and 1.11.*.
+			parts := strings.Split(condition.Version, ".")
+			prefix := strings.Join(parts[:len(parts)-1], ".")
+			ok = cmp >= 0 && compareVersions(versionPrefix(version, len(parts)-1), prefix) == 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// versionPrefix returns the first n parts of version.
+func versionPrefix(version string, n int) string {
+	parts := strings.Split(version, ".")
+	if len(parts) > n {
+		parts = parts[:n]
+	}
+	return strings.Join(parts, ".")
+}
+
+// String returns c in the pip requirement syntax, eg. `==1.11.0` or `>=1.11,<2`.
+func (c versionConstraint) String() string {
+	conditions := []string{}
+	for _, condition := range c {
+		conditions = append(conditions, condition.Operator+condition.Version)
+	}
+	return strings.Join(conditions, ",")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "1.11.0", b: "1.11", want: 0},
+		{a: "1.9", b: "1.11", want: -1},
+		{a: "2.0.0", b: "2", want: 0},
+		{a: "14", b: "13.0", want: 1},
+		{a: " 8.1 ", b: "8.1.0", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+"/"+tt.b, func(t *testing.T) {
+			if got := compareVersions(tt.a, tt.b); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVersionConstraint(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr string
+	}{
+		{value: "", want: ""},
+		{value: "1.11.0", want: "==1.11.0"},
+		{value: "=1.11.0", want: "==1.11.0"},
+		{value: "==1.11.0", want: "==1.11.0"},
+		{value: ">=1.11, <2", want: ">=1.11,<2"},
+		{value: "~=1.11", want: "~=1.11"},
+		{value: "!= 1.10.1", want: "!=1.10.1"},
+		{value: "~=1", wantErr: "~= requires at least two version parts"},
+		{value: "latest", wantErr: "is neither a version nor a constraint"},
+		{value: ">=1.11,", wantErr: "is neither a version nor a constraint"},
+		{value: "=>1.11", wantErr: "is neither a version nor a constraint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			constraint, err := parseVersionConstraint(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %s", err)
+			}
+			if got := constraint.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionConstraintSatisfiedBy(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{constraint: "", version: "1.0.0", want: true},
+		{constraint: "1.11.0", version: "1.11.0", want: true},
+		{constraint: "1.11", version: "1.11.0", want: true},
+		{constraint: "1.11.0", version: "1.11.1", want: false},
+		{constraint: "!=1.10.1", version: "1.10.1", want: false},
+		{constraint: ">=1.11,<2", version: "1.12.3", want: true},
+		{constraint: ">=1.11,<2", version: "1.10.9", want: false},
+		{constraint: "<2", version: "1.99.0", want: true},
+		{constraint: "<2", version: "2.0.0", want: false},
+		{constraint: "<=2", version: "2.0.0", want: true},
+		{constraint: ">1.11", version: "1.11.0", want: false},
+		{constraint: "~=1.11", version: "1.11.0", want: true},
+		{constraint: "~=1.11", version: "1.20.0", want: true},
+		{constraint: "~=1.11", version: "1.10.9", want: false},
+		{constraint: "~=1.11", version: "2.0.0", want: false},
+		{constraint: "~=1.11.2", version: "1.11.5", want: true},
+		{constraint: "~=1.11.2", version: "1.11.1", want: false},
+		{constraint: "~=1.11.2", version: "1.12.0", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.constraint+"/"+tt.version, func(t *testing.T) {
+			constraint, err := parseVersionConstraint(tt.constraint)
+			if err != nil {
+				t.Fatalf("got error %s", err)
+			}
+			if got := constraint.satisfiedBy(tt.version); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}